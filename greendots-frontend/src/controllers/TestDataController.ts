@@ -228,15 +228,24 @@ export class TestDataFetcher {
   }
 }
 
+// A known issue rule matching a failure, only present in the status summary
+export type KnownIssue = {
+  rule: string;
+  ticket: string;
+  label: string;
+  ticket_url?: string;
+};
+
 export type TestStatusUpdateEvent =
   | { type: 'summary_done' }
   | { type: 'start'; test: string }
   | { type: 'progress'; percentage: number }
   | {
       type: 'setup' | 'call' | 'teardown' | 'finish';
-      outcome: 'passed' | 'failed' | 'error' | 'skipped';
+      outcome: 'passed' | 'failed' | 'error' | 'skipped' | 'crashed' | 'hung';
       test: string;
       exception?: string;
+      known_issue?: KnownIssue;
     };
 
 // Keep this list in sync with the fields in `TestItem`
@@ -270,6 +279,7 @@ export type TestItem = {
   exception?: string; // The whole exception
   ex?: string; // A short hash of the exception
   ex_color?: string; // A color derived from the exception hash
+  known_issue?: KnownIssue;
 };
 
 export type Row = {
@@ -295,6 +305,7 @@ export type ExceptionData = {
   long_text: string;
   color: string;
   count: number;
+  known_issue?: KnownIssue; // Of the first test of this group that matched one
 };
 export type ExceptionMap = { [id: string]: ExceptionData };
 
@@ -591,7 +602,9 @@ export class TestDataProcessor {
         }
       } else if (
         (status_update as any).outcome == 'failed' ||
-        (status_update as any).outcome == 'error'
+        (status_update as any).outcome == 'error' ||
+        (status_update as any).outcome == 'crashed' ||
+        (status_update as any).outcome == 'hung'
       ) {
         test.status = 'fail';
         test.progress = 1;
@@ -599,6 +612,7 @@ export class TestDataProcessor {
         // Use the last line as the exception key
         test.exception = new_exception;
         test.exception_title = new_exception ? new_exception.split('\n').pop()?.trim() : undefined;
+        test.known_issue = (status_update as any).known_issue;
 
         let ex_changed = false;
         if (test.ex !== undefined) {
@@ -618,10 +632,14 @@ export class TestDataProcessor {
               // Also store (one of the) the full exception texts
               long_text: (status_update as any).exception,
               color: test.ex_color!,
-              count: 1
+              count: 1,
+              known_issue: test.known_issue
             };
           } else {
             this.exceptions[test.ex].count += 1;
+            if (!this.exceptions[test.ex].known_issue) {
+              this.exceptions[test.ex].known_issue = test.known_issue;
+            }
           }
           ex_changed = true;
         }
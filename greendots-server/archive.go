@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -- Run archives --
+//
+// Completed runs may be archived as a single `<run>.tar`, `<run>.tar.gz`,
+// `<run>.tar.zst` or `<run>.zip` next to the run directories. Their members
+// are read in place: uncompressed tar members and stored zip members are plain
+// byte ranges of the archive, compressed tars are read through the same
+// restart point index used for compressed files, and deflated zip members are
+// decompressed from their start when seeking backwards.
+//
+// The member table of each archive is built once and cached by path, size and mtime.
+
+type archiveKind int
+
+const (
+	archiveTar archiveKind = iota
+	archiveTarGzip
+	archiveTarZstd
+	archiveZip
+)
+
+var archiveSuffixes = []struct {
+	suffix string
+	kind   archiveKind
+}{
+	{".tar", archiveTar},
+	{".tar.gz", archiveTarGzip},
+	{".tgz", archiveTarGzip},
+	{".tar.zst", archiveTarZstd},
+	{".zip", archiveZip},
+}
+
+const archiveIndexMaxSize = 1024
+
+type archiveMember struct {
+	offset         int64
+	size           int64
+	compressedSize int64
+	deflated       bool
+	modTime        time.Time
+}
+
+type archiveIndex struct {
+	kind    archiveKind
+	members map[string]archiveMember
+	// The decompressed view of compressed tars
+	stream   *compressedIndex
+	lastUsed time.Time
+}
+
+type archiveIndexKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+var archiveIndexCache = struct {
+	sync.Mutex
+	entries map[archiveIndexKey]*archiveIndex
+}{entries: make(map[archiveIndexKey]*archiveIndex)}
+
+// Returns the run id of an archive file name, if it is one
+func archiveRunId(fileName string) (string, archiveKind, bool) {
+	for _, variant := range archiveSuffixes {
+		if runId, found := strings.CutSuffix(fileName, variant.suffix); found && runId != "" {
+			return runId, variant.kind, true
+		}
+	}
+	return "", 0, false
+}
+
+// Finds the archive of a run, returning an error matching fs.ErrNotExist if there is none
+func findRunArchive(projectPath string, run string) (string, archiveKind, error) {
+	for _, variant := range archiveSuffixes {
+		archivePath := filepath.Join(projectPath, run+variant.suffix)
+		info, err := os.Stat(archivePath)
+		if err == nil && info.Mode().IsRegular() {
+			return archivePath, variant.kind, nil
+		}
+	}
+	return "", 0, fmt.Errorf("run '%s' archive: %w", run, fs.ErrNotExist)
+}
+
+// Normalizes a member name, so both `plan.json` and `./<run>/plan.json` are found as `plan.json`
+func archiveMemberName(run string, name string) string {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if trimmed, found := strings.CutPrefix(name, run+"/"); found {
+		return trimmed
+	}
+	return name
+}
+
+func getArchiveIndex(archivePath string, run string, kind archiveKind, fd *os.File) (*archiveIndex, error) {
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	key := archiveIndexKey{archivePath, info.Size(), info.ModTime()}
+
+	archiveIndexCache.Lock()
+	if index, ok := archiveIndexCache.entries[key]; ok {
+		index.lastUsed = time.Now()
+		archiveIndexCache.Unlock()
+		return index, nil
+	}
+	archiveIndexCache.Unlock()
+
+	index := &archiveIndex{kind: kind, members: make(map[string]archiveMember)}
+	switch kind {
+	case archiveTar:
+		err = indexTarMembers(index, run, fd)
+	case archiveTarGzip, archiveTarZstd:
+		compression := compressionGzip
+		if kind == archiveTarZstd {
+			compression = compressionZstd
+		}
+		index.stream, err = getCompressedIndex("", "", archivePath, compression, fsStorageFile{fd})
+		if err == nil {
+			stream := &compressedFile{raw: fsStorageFile{fd}, index: index.stream}
+			err = indexTarMembers(index, run, stream)
+			stream.resetReader()
+		}
+	case archiveZip:
+		err = indexZipMembers(index, run, fd, info.Size())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("indexing archive '%s': %w", archivePath, err)
+	}
+	index.lastUsed = time.Now()
+
+	archiveIndexCache.Lock()
+	defer archiveIndexCache.Unlock()
+	if len(archiveIndexCache.entries) >= archiveIndexMaxSize {
+		// Evict the least recently used index
+		var oldestKey archiveIndexKey
+		var oldest *archiveIndex
+		for k, v := range archiveIndexCache.entries {
+			if oldest == nil || v.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = k, v
+			}
+		}
+		delete(archiveIndexCache.entries, oldestKey)
+	}
+	archiveIndexCache.entries[key] = index
+	return index, nil
+}
+
+func indexTarMembers(index *archiveIndex, run string, stream io.Reader) error {
+	// Hide any Seek method, so skipping data never restarts decompression,
+	// and count the bytes to know where the data of each member starts
+	counter := &countingReader{r: stream}
+	tr := tar.NewReader(counter)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		index.members[archiveMemberName(run, header.Name)] = archiveMember{
+			offset:  counter.n,
+			size:    header.Size,
+			modTime: header.ModTime,
+		}
+	}
+}
+
+func indexZipMembers(index *archiveIndex, run string, fd *os.File, size int64) error {
+	zr, err := zip.NewReader(fd, size)
+	if err != nil {
+		return err
+	}
+	for _, file := range zr.File {
+		if file.Mode().IsDir() {
+			continue
+		}
+		if file.Method != zip.Store && file.Method != zip.Deflate {
+			continue
+		}
+		offset, err := file.DataOffset()
+		if err != nil {
+			return err
+		}
+		index.members[archiveMemberName(run, file.Name)] = archiveMember{
+			offset:         offset,
+			size:           int64(file.UncompressedSize64),
+			compressedSize: int64(file.CompressedSize64),
+			deflated:       file.Method == zip.Deflate,
+			modTime:        file.Modified,
+		}
+	}
+	return nil
+}
+
+func (s *fsStorage) openArchivedRunFile(project string, run string, name string) (storageFile, error) {
+	archivePath, kind, err := findRunArchive(filepath.Join(s.root, project), run)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	index, err := getArchiveIndex(archivePath, run, kind, fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	member, ok := index.members[name]
+	if !ok {
+		fd.Close()
+		return nil, fmt.Errorf("'%s' in '%s': %w", name, archivePath, fs.ErrNotExist)
+	}
+
+	var base storageFile = fsStorageFile{fd}
+	if index.stream != nil {
+		base = &compressedFile{raw: base, index: index.stream}
+	}
+	if member.deflated {
+		return &deflatedFile{fd: fd, member: member}, nil
+	}
+	return &sectionFile{base: base, member: member}, nil
+}
+
+// A byte range of a (possibly decompressed) archive
+type sectionFile struct {
+	base   storageFile
+	member archiveMember
+	offset int64
+}
+
+func (f *sectionFile) Read(p []byte) (int, error) {
+	if f.offset >= f.member.size {
+		return 0, io.EOF
+	}
+	_, err := f.base.Seek(f.member.offset+f.offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	p = p[:min(int64(len(p)), f.member.size-f.offset)]
+	n, err := f.base.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *sectionFile) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := seekOffset(f.offset, f.member.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	f.offset = newOffset
+	return newOffset, nil
+}
+
+func (f *sectionFile) Stat() (storageFileInfo, error) {
+	return storageFileInfo{Size: f.member.size, ModTime: f.member.modTime}, nil
+}
+
+func (f *sectionFile) Close() error {
+	return f.base.Close()
+}
+
+// A deflated zip member, which is decompressed again from its start when seeking backwards
+type deflatedFile struct {
+	fd        *os.File
+	member    archiveMember
+	offset    int64
+	reader    io.ReadCloser
+	readerPos int64
+}
+
+func (f *deflatedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.member.size {
+		return 0, io.EOF
+	}
+	if f.reader == nil || f.readerPos > f.offset {
+		if f.reader != nil {
+			f.reader.Close()
+		}
+		section := io.NewSectionReader(f.fd, f.member.offset, f.member.compressedSize)
+		f.reader = flate.NewReader(section)
+		f.readerPos = 0
+	}
+	if f.readerPos < f.offset {
+		n, err := io.CopyN(io.Discard, f.reader, f.offset-f.readerPos)
+		f.readerPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.reader.Read(p)
+	f.offset += int64(n)
+	f.readerPos = f.offset
+	if err == io.EOF && n > 0 {
+		// Callers treat EOF as "no data", like with regular files
+		err = nil
+	}
+	return n, err
+}
+
+func (f *deflatedFile) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := seekOffset(f.offset, f.member.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	f.offset = newOffset
+	return newOffset, nil
+}
+
+func (f *deflatedFile) Stat() (storageFileInfo, error) {
+	return storageFileInfo{Size: f.member.size, ModTime: f.member.modTime}, nil
+}
+
+func (f *deflatedFile) Close() error {
+	if f.reader != nil {
+		f.reader.Close()
+	}
+	return f.fd.Close()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// -- Run comparison --
+
+type compareEntry struct {
+	Test string `json:"test"`
+	// nil for tests that are missing from that run
+	Base *testResult `json:"base"`
+	Head *testResult `json:"head"`
+}
+
+type compareResult struct {
+	Base             string         `json:"base"`
+	Head             string         `json:"head"`
+	NewlyFailing     []compareEntry `json:"newly_failing"`
+	NewlyPassing     []compareEntry `json:"newly_passing"`
+	StillFailing     []compareEntry `json:"still_failing"`
+	Added            []compareEntry `json:"added"`
+	Removed          []compareEntry `json:"removed"`
+	ExceptionChanged []compareEntry `json:"exception_changed"`
+}
+
+func isFailingOutcome(outcome string) bool {
+	return outcome == "failed" || outcome == "error"
+}
+
+// Returns a single run of a project, as listed by getProjectRuns
+func getProjectRun(project string, run_id string) (run, bool) {
+	runs, err := getProjectRuns(project)
+	if err != nil {
+		return run{}, false
+	}
+	for _, r := range runs {
+		if r.Id == run_id {
+			return r, true
+		}
+	}
+	return run{}, false
+}
+
+func getListedRunTestResults(project string, run_id string) (map[string]testResult, error) {
+	listed, ok := getProjectRun(project, run_id)
+	created := time.Time{}
+	if ok {
+		created, _ = time.Parse(time.RFC3339, listed.CreatedAt)
+	}
+	return getRunTestResults(project, run_id, created)
+}
+
+func compareRuns(base map[string]testResult, head map[string]testResult) compareResult {
+	result := compareResult{
+		NewlyFailing:     []compareEntry{},
+		NewlyPassing:     []compareEntry{},
+		StillFailing:     []compareEntry{},
+		Added:            []compareEntry{},
+		Removed:          []compareEntry{},
+		ExceptionChanged: []compareEntry{},
+	}
+
+	for test, head_result := range head {
+		entry := compareEntry{Test: test, Head: &head_result}
+		base_result, ok := base[test]
+		if !ok {
+			result.Added = append(result.Added, entry)
+			continue
+		}
+		entry.Base = &base_result
+
+		base_failing := isFailingOutcome(base_result.Outcome)
+		head_failing := isFailingOutcome(head_result.Outcome)
+		switch {
+		case head_failing && base_failing:
+			result.StillFailing = append(result.StillFailing, entry)
+		case head_failing:
+			result.NewlyFailing = append(result.NewlyFailing, entry)
+		case base_failing && head_result.Outcome == "passed":
+			result.NewlyPassing = append(result.NewlyPassing, entry)
+		}
+		if head_failing && base_failing && head_result.ExceptionTitle != base_result.ExceptionTitle {
+			result.ExceptionChanged = append(result.ExceptionChanged, entry)
+		}
+	}
+	for test, base_result := range base {
+		if _, ok := head[test]; !ok {
+			result.Removed = append(result.Removed, compareEntry{Test: test, Base: &base_result})
+		}
+	}
+
+	for _, entries := range [][]compareEntry{
+		result.NewlyFailing, result.NewlyPassing, result.StillFailing,
+		result.Added, result.Removed, result.ExceptionChanged,
+	} {
+		sort.Slice(entries, func(i int, j int) bool {
+			return entries[i].Test < entries[j].Test
+		})
+	}
+	return result
+}
+
+func compareRunsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	base := r.URL.Query().Get("base")
+	head := r.URL.Query().Get("head")
+	if base == "" || head == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if isDirTraversal(project) || isDirTraversal(base) || isDirTraversal(head) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	base_results, err := getListedRunTestResults(project, base)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	head_results, err := getListedRunTestResults(project, head)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	result := compareRuns(base_results, head_results)
+	result.Base = base
+	result.Head = head
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
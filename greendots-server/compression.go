@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// -- Compressed files --
+//
+// Finished runs may have their status and log files compressed, so when a
+// plain file is missing we look for a `.gz` or `.zst` variant and serve it
+// decompressed. Offsets and sizes are always in decompressed bytes, so the
+// `X-End-Offset`/Range dance of the frontend keeps working.
+//
+// Seeking (for ranged reads and tails) uses an index of restart points, one per
+// gzip member or zstd frame. Seekable zstd files (with a seek table) and frames
+// that record their content size are indexed without decompressing anything,
+// otherwise the file is decompressed once when the index is built. Files
+// compressed as a single member/frame still work, but seeking in them means
+// decompressing from the start.
+
+type compressionKind int
+
+const (
+	compressionGzip compressionKind = iota
+	compressionZstd
+)
+
+var compressedSuffixes = []struct {
+	suffix string
+	kind   compressionKind
+}{
+	{".gz", compressionGzip},
+	{".zst", compressionZstd},
+}
+
+const (
+	zstdFrameMagic         = 0xFD2FB528
+	zstdSkippableMagicMask = 0xFFFFFFF0
+	zstdSkippableMagic     = 0x184D2A50
+	zstdSeekableMagic      = 0x8F92EAB1
+	zstdSeekTableFooterLen = 9
+	compressedIndexMaxSize = 4096
+)
+
+type compressedRestartPoint struct {
+	compressedOffset   int64
+	decompressedOffset int64
+}
+
+type compressedIndex struct {
+	kind     compressionKind
+	size     int64
+	restarts []compressedRestartPoint
+	lastUsed time.Time
+}
+
+type compressedIndexKey struct {
+	project string
+	run     string
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+var compressedIndexCache = struct {
+	sync.Mutex
+	entries map[compressedIndexKey]*compressedIndex
+}{entries: make(map[compressedIndexKey]*compressedIndex)}
+
+// Opens a run file, falling back to its compressed variants if the plain file doesn't exist
+func openRunFileMaybeCompressed(project string, run string, name string) (storageFile, error) {
+	fd, err := storage.OpenRunFile(project, run, name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fd, err
+	}
+
+	for _, variant := range compressedSuffixes {
+		raw, err := storage.OpenRunFile(project, run, name+variant.suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		index, err := getCompressedIndex(project, run, name+variant.suffix, variant.kind, raw)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return &compressedFile{raw: raw, index: index}, nil
+	}
+	return nil, err
+}
+
+// Stats a run file, falling back to its compressed variants (reporting the decompressed size)
+func statRunFileMaybeCompressed(project string, run string, name string) (storageFileInfo, error) {
+	info, err := storage.StatRunFile(project, run, name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+
+	fd, err := openRunFileMaybeCompressed(project, run, name)
+	if err != nil {
+		return storageFileInfo{}, err
+	}
+	defer fd.Close()
+	return fd.Stat()
+}
+
+func getCompressedIndex(project string, run string, name string, kind compressionKind, raw storageFile) (*compressedIndex, error) {
+	stat, err := raw.Stat()
+	if err != nil {
+		return nil, err
+	}
+	key := compressedIndexKey{project, run, name, stat.Size, stat.ModTime}
+
+	compressedIndexCache.Lock()
+	if index, ok := compressedIndexCache.entries[key]; ok {
+		index.lastUsed = time.Now()
+		compressedIndexCache.Unlock()
+		return index, nil
+	}
+	compressedIndexCache.Unlock()
+
+	var index *compressedIndex
+	switch kind {
+	case compressionGzip:
+		index, err = buildGzipIndex(raw)
+	case compressionZstd:
+		index, err = buildZstdIndex(raw, stat.Size)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("indexing '%s/%s/%s': %w", project, run, name, err)
+	}
+	index.kind = kind
+	index.lastUsed = time.Now()
+
+	compressedIndexCache.Lock()
+	defer compressedIndexCache.Unlock()
+	if len(compressedIndexCache.entries) >= compressedIndexMaxSize {
+		// Evict the least recently used index
+		var oldestKey compressedIndexKey
+		var oldest *compressedIndex
+		for k, v := range compressedIndexCache.entries {
+			if oldest == nil || v.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = k, v
+			}
+		}
+		delete(compressedIndexCache.entries, oldestKey)
+	}
+	compressedIndexCache.entries[key] = index
+	return index, nil
+}
+
+// Counts the bytes consumed from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Decompresses every gzip member once, noting where each one starts
+func buildGzipIndex(raw storageFile) (*compressedIndex, error) {
+	_, err := raw.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	// The gzip reader doesn't over-read from an io.ByteReader, so the counter
+	// minus whatever is still buffered is the exact end of each member
+	counter := &countingReader{r: raw}
+	buffered := bufio.NewReader(counter)
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	index := &compressedIndex{}
+	memberStart := int64(0)
+	for {
+		gz.Multistream(false)
+		index.restarts = append(index.restarts, compressedRestartPoint{memberStart, index.size})
+		n, err := io.Copy(io.Discard, gz)
+		if err != nil {
+			return nil, err
+		}
+		index.size += n
+
+		memberStart = counter.n - int64(buffered.Buffered())
+		err = gz.Reset(buffered)
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads the seek table of the seekable zstd format, if the file has one
+func readZstdSeekTable(raw storageFile, size int64) (*compressedIndex, bool) {
+	if size < zstdSeekTableFooterLen+8 {
+		return nil, false
+	}
+	footer := make([]byte, zstdSeekTableFooterLen)
+	_, err := raw.Seek(size-zstdSeekTableFooterLen, io.SeekStart)
+	if err == nil {
+		_, err = io.ReadFull(raw, footer)
+	}
+	if err != nil || binary.LittleEndian.Uint32(footer[5:]) != zstdSeekableMagic {
+		return nil, false
+	}
+
+	frameCount := int64(binary.LittleEndian.Uint32(footer[:4]))
+	entryLen := int64(8)
+	if footer[4]&0x80 != 0 {
+		// Entries also carry a checksum
+		entryLen = 12
+	}
+	tableLen := frameCount * entryLen
+	if tableLen > size-zstdSeekTableFooterLen {
+		return nil, false
+	}
+	table := make([]byte, tableLen)
+	_, err = raw.Seek(size-zstdSeekTableFooterLen-tableLen, io.SeekStart)
+	if err == nil {
+		_, err = io.ReadFull(raw, table)
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	index := &compressedIndex{}
+	compressedOffset := int64(0)
+	for i := int64(0); i < frameCount; i++ {
+		entry := table[i*entryLen:]
+		index.restarts = append(index.restarts, compressedRestartPoint{compressedOffset, index.size})
+		compressedOffset += int64(binary.LittleEndian.Uint32(entry[0:]))
+		index.size += int64(binary.LittleEndian.Uint32(entry[4:]))
+	}
+	return index, true
+}
+
+type zstdFrameInfo struct {
+	offset      int64
+	length      int64
+	contentSize int64 // -1 if the frame header doesn't say
+}
+
+// Walks the zstd frames of a file by their headers, without decompressing them
+func walkZstdFrames(raw storageFile) ([]zstdFrameInfo, error) {
+	_, err := raw.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: raw}
+	buffered := bufio.NewReader(counter)
+	pos := func() int64 { return counter.n - int64(buffered.Buffered()) }
+
+	frames := []zstdFrameInfo{}
+	header := make([]byte, 8)
+	for {
+		start := pos()
+		_, err := io.ReadFull(buffered, header[:4])
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		magic := binary.LittleEndian.Uint32(header)
+
+		if magic&zstdSkippableMagicMask == zstdSkippableMagic {
+			_, err = io.ReadFull(buffered, header[:4])
+			if err == nil {
+				_, err = buffered.Discard(int(binary.LittleEndian.Uint32(header)))
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if magic != zstdFrameMagic {
+			return nil, fmt.Errorf("bad zstd frame magic at offset %d", start)
+		}
+
+		descriptor, err := buffered.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		singleSegment := descriptor&0x20 != 0
+		skip := []int{0, 1, 2, 4}[descriptor&0x3]
+		if !singleSegment {
+			skip += 1
+		}
+		_, err = buffered.Discard(skip)
+		if err != nil {
+			return nil, err
+		}
+
+		contentSize := int64(-1)
+		fcsLen := []int{0, 2, 4, 8}[descriptor>>6]
+		if fcsLen == 0 && singleSegment {
+			fcsLen = 1
+		}
+		if fcsLen > 0 {
+			clear(header)
+			_, err = io.ReadFull(buffered, header[:fcsLen])
+			if err != nil {
+				return nil, err
+			}
+			contentSize = int64(binary.LittleEndian.Uint64(header))
+			if fcsLen == 2 {
+				contentSize += 256
+			}
+		}
+
+		// Skip over the blocks
+		for {
+			_, err = io.ReadFull(buffered, header[:3])
+			if err != nil {
+				return nil, err
+			}
+			blockHeader := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+			blockSize := int(blockHeader >> 3)
+			if (blockHeader>>1)&0x3 == 1 {
+				// RLE blocks store a single byte
+				blockSize = 1
+			}
+			_, err = buffered.Discard(blockSize)
+			if err != nil {
+				return nil, err
+			}
+			if blockHeader&1 != 0 {
+				break
+			}
+		}
+		if descriptor&0x4 != 0 {
+			_, err = buffered.Discard(4)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		frames = append(frames, zstdFrameInfo{offset: start, length: pos() - start, contentSize: contentSize})
+	}
+}
+
+func buildZstdIndex(raw storageFile, size int64) (*compressedIndex, error) {
+	if index, ok := readZstdSeekTable(raw, size); ok {
+		return index, nil
+	}
+
+	frames, err := walkZstdFrames(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &compressedIndex{}
+	for _, frame := range frames {
+		index.restarts = append(index.restarts, compressedRestartPoint{frame.offset, index.size})
+		if frame.contentSize >= 0 {
+			index.size += frame.contentSize
+			continue
+		}
+
+		// The frame doesn't know its own size, decompress it to find out
+		_, err = raw.Seek(frame.offset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		dec, err := zstd.NewReader(io.LimitReader(raw, frame.length), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.Copy(io.Discard, dec)
+		dec.Close()
+		if err != nil {
+			return nil, err
+		}
+		index.size += n
+	}
+	return index, nil
+}
+
+// A decompressed view of a compressed storage file, see above
+type compressedFile struct {
+	raw    storageFile
+	index  *compressedIndex
+	offset int64
+
+	reader    io.Reader
+	closer    func()
+	readerPos int64
+}
+
+func (f *compressedFile) resetReader() {
+	if f.closer != nil {
+		f.closer()
+	}
+	f.reader = nil
+	f.closer = nil
+}
+
+func (f *compressedFile) openReader() error {
+	// Start from the last restart point before the offset
+	restart := compressedRestartPoint{}
+	for _, point := range f.index.restarts {
+		if point.decompressedOffset > f.offset {
+			break
+		}
+		restart = point
+	}
+
+	_, err := f.raw.Seek(restart.compressedOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewReader(f.raw)
+
+	switch f.index.kind {
+	case compressionGzip:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		f.reader = gz
+		f.closer = func() { gz.Close() }
+	case compressionZstd:
+		dec, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		f.reader = dec
+		f.closer = dec.Close
+	}
+
+	_, err = io.CopyN(io.Discard, f.reader, f.offset-restart.decompressedOffset)
+	if err != nil && err != io.EOF {
+		f.resetReader()
+		return err
+	}
+	f.readerPos = f.offset
+	return nil
+}
+
+func (f *compressedFile) Read(p []byte) (int, error) {
+	if f.offset >= f.index.size {
+		return 0, io.EOF
+	}
+	if f.reader == nil || f.readerPos != f.offset {
+		f.resetReader()
+		err := f.openReader()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.reader.Read(p)
+	f.offset += int64(n)
+	f.readerPos = f.offset
+	if err == io.EOF && n > 0 {
+		// Callers treat EOF as "no data", like with regular files
+		err = nil
+	}
+	return n, err
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := seekOffset(f.offset, f.index.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	f.offset = newOffset
+	return newOffset, nil
+}
+
+func (f *compressedFile) Stat() (storageFileInfo, error) {
+	info, err := f.raw.Stat()
+	if err != nil {
+		return storageFileInfo{}, err
+	}
+	return storageFileInfo{Size: f.index.size, ModTime: info.ModTime}, nil
+}
+
+func (f *compressedFile) Close() error {
+	f.resetReader()
+	return f.raw.Close()
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -- Email digests --
+//
+// Every day at `send_at` (server local time, "HH:MM"), each owner listed in
+// the `owners` of a project `metadata.toml` gets one email over SMTP covering
+// all of their projects: the runs of the last day, the pass rate of each of
+// the last `trend_days` days, the tests that started failing in the last day,
+// and the most flaky tests.
+//
+// The day of the last digest sent to each owner is saved under `state_dir`
+// (`notifications/digests.json`), so a restart doesn't send it twice, and a
+// digest that was missed while the server was down is sent once it's back.
+// Owners that aren't a valid email address are skipped.
+
+const digestOwnersKey = "owners"
+
+// A failed digest is sent again after this long
+const digestRetryInterval = 10 * time.Minute
+
+type digestFailure struct {
+	Test           string
+	Run            string
+	ExceptionTitle string
+}
+
+type projectDigest struct {
+	Project string
+	// Newest first
+	Runs []run
+	// Passed tests out of the passed and failing ones on each day, oldest
+	// first, negative for days without any
+	Trend       []float64
+	NewFailures []digestFailure
+	Flaky       flakyReport
+}
+
+type digestsState struct {
+	// The day of the last digest of each owner, as "2006-01-02"
+	Sent map[string]string `json:"sent"`
+}
+
+func projectUrl(project string) string {
+	return config.Notifications.BaseUrl + "/" + url.PathEscape(project)
+}
+
+func loadDigestsState() digestsState {
+	state := digestsState{Sent: make(map[string]string)}
+	data, err := os.ReadFile(notificationsPath("digests.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to read the digests state, starting over: %v", err)
+	}
+	if state.Sent == nil {
+		state.Sent = make(map[string]string)
+	}
+	return state
+}
+
+func saveDigestsState(state digestsState) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeStateFile(notificationsPath("digests.json"), data)
+	}
+	if err != nil {
+		log.Printf("Failed to save the digests state: %v", err)
+	}
+}
+
+func startDigests() {
+	if config.Notifications.Digest.SendAt == "" {
+		return
+	}
+	send_at, err := time.Parse("15:04", config.Notifications.Digest.SendAt)
+	if err != nil {
+		log.Fatalf("Invalid digest send_at '%s': %v", config.Notifications.Digest.SendAt, err)
+	}
+	if config.Notifications.Smtp.Host == "" || config.Notifications.Smtp.From == "" {
+		log.Fatalf("Digests need notifications.smtp.host and notifications.smtp.from")
+	}
+	if config.StateDir == "" {
+		log.Fatalf("Digests need `state_dir`, to remember what was already sent")
+	}
+
+	go func() {
+		state := loadDigestsState()
+		for {
+			now := time.Now()
+			due := time.Date(now.Year(), now.Month(), now.Day(), send_at.Hour(), send_at.Minute(), 0, 0, time.Local)
+			if now.Before(due) {
+				time.Sleep(due.Sub(now))
+				continue
+			}
+
+			next := time.Date(now.Year(), now.Month(), now.Day()+1, send_at.Hour(), send_at.Minute(), 0, 0, time.Local)
+			sent := sendDigests(&state, due.Format(time.DateOnly))
+			if retry := time.Now().Add(digestRetryInterval); !sent && retry.Before(next) {
+				next = retry
+			}
+			time.Sleep(time.Until(next))
+		}
+	}()
+}
+
+// Returns the email addresses of the owners listed in the metadata of a project
+func getProjectOwners(project string) []string {
+	metadata, err := getProjectMetadata(project)
+	if err != nil {
+		return nil
+	}
+	var owners []interface{}
+	switch value := metadata[digestOwnersKey].(type) {
+	case string:
+		owners = []interface{}{value}
+	case []interface{}:
+		owners = value
+	}
+
+	emails := []string{}
+	for _, owner := range owners {
+		text, _ := owner.(string)
+		// Also keeps anything but the address itself out of the email headers
+		address, err := mail.ParseAddress(text)
+		if err != nil {
+			log.Printf("Skipping invalid owner %q of '%s': %v", text, project, err)
+			continue
+		}
+		emails = append(emails, address.Address)
+	}
+	return emails
+}
+
+// Sends the digest of the given day to every owner that didn't get it yet,
+// returns false if any of them failed
+func sendDigests(state *digestsState, day string) bool {
+	projects, err := storage.ListProjects()
+	if err != nil {
+		log.Printf("Failed to list the projects for digests: %v", err)
+		return false
+	}
+	sort.Strings(projects)
+
+	owned := make(map[string][]string)
+	for _, project := range projects {
+		for _, owner := range getProjectOwners(project) {
+			if state.Sent[owner] != day {
+				owned[owner] = append(owned[owner], project)
+			}
+		}
+	}
+	if len(owned) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	digests := make(map[string]projectDigest)
+	ok := true
+	for owner, owned_projects := range owned {
+		project_digests := []projectDigest{}
+		for _, project := range owned_projects {
+			digest, found := digests[project]
+			if !found {
+				digest = getProjectDigest(project, now)
+				digests[project] = digest
+			}
+			project_digests = append(project_digests, digest)
+		}
+
+		err := sendDigestEmail(owner, formatDigest(project_digests, now))
+		if err != nil {
+			log.Printf("Failed to send the digest to '%s': %v", owner, err)
+			ok = false
+			continue
+		}
+		state.Sent[owner] = day
+		saveDigestsState(*state)
+	}
+	return ok
+}
+
+func getProjectDigest(project string, now time.Time) projectDigest {
+	digest := projectDigest{Project: project, Runs: []run{}, NewFailures: []digestFailure{}}
+	runs, err := getProjectRuns(project)
+	if err != nil {
+		return digest
+	}
+
+	// Only the runs of the trend need their details
+	day := 24 * time.Hour
+	trend_days := max(config.Notifications.Digest.TrendDays, 1)
+	trend_runs := len(runs)
+	for i, listed := range runs {
+		created, err := time.Parse(time.RFC3339, listed.CreatedAt)
+		if err == nil && int(now.Sub(created)/day) >= trend_days {
+			trend_runs = i
+			break
+		}
+	}
+	fillRunDetails(project, runs[:trend_runs])
+
+	passed := make([]int, trend_days)
+	total := make([]int, trend_days)
+	seen_failures := make(map[string]bool)
+	for i, listed := range runs {
+		created, err := time.Parse(time.RFC3339, listed.CreatedAt)
+		if err != nil {
+			continue
+		}
+		age := int(now.Sub(created) / day)
+		if age >= trend_days {
+			// The runs are listed newest first
+			break
+		}
+		if listed.Counts != nil && age >= 0 {
+			passed[trend_days-1-age] += listed.Counts.Passed
+			total[trend_days-1-age] += listed.Counts.Passed + listed.Counts.Failed + listed.Counts.Error
+		}
+		if age != 0 {
+			continue
+		}
+		digest.Runs = append(digest.Runs, listed)
+
+		if listed.State != runStateFinished || i+1 >= len(runs) {
+			continue
+		}
+		results, err := getRunTestResults(project, listed.Id, created)
+		if err != nil {
+			continue
+		}
+		previous_created, err := time.Parse(time.RFC3339, runs[i+1].CreatedAt)
+		if err != nil {
+			previous_created = time.Time{}
+		}
+		previous_results, err := getRunTestResults(project, runs[i+1].Id, previous_created)
+		if err != nil {
+			continue
+		}
+		for _, entry := range compareRuns(previous_results, results).NewlyFailing {
+			if seen_failures[entry.Test] {
+				continue
+			}
+			seen_failures[entry.Test] = true
+			digest.NewFailures = append(digest.NewFailures, digestFailure{
+				Test:           entry.Test,
+				Run:            listed.Id,
+				ExceptionTitle: entry.Head.ExceptionTitle,
+			})
+		}
+	}
+
+	digest.Trend = make([]float64, trend_days)
+	for i := range digest.Trend {
+		digest.Trend[i] = -1
+		if total[i] > 0 {
+			digest.Trend[i] = float64(passed[i]) / float64(total[i])
+		}
+	}
+	digest.Flaky = getFlakyReport(project, runs[:min(config.History.DefaultRuns, len(runs))])
+	return digest
+}
+
+func formatDigest(digests []projectDigest, now time.Time) string {
+	max_tests := config.Notifications.Digest.MaxTests
+	var b strings.Builder
+	fmt.Fprintf(&b, "Greendots digest for the day until %s\n", now.Format("2006-01-02 15:04 MST"))
+
+	for _, digest := range digests {
+		fmt.Fprintf(&b, "\n== %s ==\n%s\n\n", digest.Project, projectUrl(digest.Project))
+
+		fmt.Fprintf(&b, "Runs in the last day: %d\n", len(digest.Runs))
+		for _, listed := range digest.Runs {
+			fmt.Fprintf(&b, "  %s (%s", listed.Id, listed.State)
+			if listed.Counts != nil {
+				fmt.Fprintf(&b, ": %d passed, %d failed, %d error, %d skipped",
+					listed.Counts.Passed, listed.Counts.Failed, listed.Counts.Error, listed.Counts.Skipped)
+			}
+			fmt.Fprintf(&b, ")\n    %s\n", runUrl(digest.Project, listed.Id))
+		}
+
+		rates := make([]string, 0, len(digest.Trend))
+		for _, rate := range digest.Trend {
+			if rate < 0 {
+				rates = append(rates, "-")
+			} else {
+				rates = append(rates, strconv.FormatFloat(rate*100, 'f', 1, 64)+"%")
+			}
+		}
+		fmt.Fprintf(&b, "\nPass rate of the last %d days, oldest first: %s\n", len(digest.Trend), strings.Join(rates, " "))
+
+		fmt.Fprintf(&b, "\nNew failures: %d\n", len(digest.NewFailures))
+		for _, failure := range digest.NewFailures[:min(len(digest.NewFailures), max_tests)] {
+			fmt.Fprintf(&b, "  %s (in %s)\n", failure.Test, failure.Run)
+			if failure.ExceptionTitle != "" {
+				fmt.Fprintf(&b, "    %s\n", failure.ExceptionTitle)
+			}
+			fmt.Fprintf(&b, "    %s\n", config.Notifications.BaseUrl+testLogUrl(digest.Project, failure.Run, failure.Test))
+		}
+
+		fmt.Fprintf(&b, "\nFlaky tests in the last %d runs: %d\n", len(digest.Flaky.Runs), len(digest.Flaky.Tests))
+		for _, flaky := range digest.Flaky.Tests[:min(len(digest.Flaky.Tests), max_tests)] {
+			fmt.Fprintf(&b, "  %s (score %.2f, %d flips, %d reruns)\n", flaky.Test, flaky.Score, len(flaky.Flips), len(flaky.Reruns))
+		}
+	}
+	return b.String()
+}
+
+func sendDigestEmail(to string, body string) error {
+	smtp_config := config.Notifications.Smtp
+	var auth smtp.Auth
+	if smtp_config.Username != "" {
+		auth = smtp.PlainAuth("", smtp_config.Username, smtp_config.Password, smtp_config.Host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", smtp_config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	msg.WriteString("Subject: Greendots daily digest\r\n")
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	// Uses STARTTLS when the relay supports it
+	addr := net.JoinHostPort(smtp_config.Host, strconv.Itoa(smtp_config.Port))
+	return smtp.SendMail(addr, auth, smtp_config.From, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testEmail struct {
+	from string
+	to   []string
+	data string
+}
+
+// A minimal SMTP server, without STARTTLS or AUTH, that keeps every email it gets
+type testSmtpServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	emails   []testEmail
+}
+
+func newTestSmtpServer(t *testing.T) *testSmtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSmtpServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *testSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	email := testEmail{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimRight(line, "\r\n"))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			email = testEmail{from: strings.Trim(strings.TrimSpace(line[len("MAIL FROM:"):]), "<>\r\n")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			email.to = append(email.to, strings.Trim(strings.TrimSpace(line[len("RCPT TO:"):]), "<>\r\n"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			email.data = data.String()
+			s.mu.Lock()
+			s.emails = append(s.emails, email)
+			s.mu.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *testSmtpServer) received() []testEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testEmail{}, s.emails...)
+}
+
+func TestDigests(t *testing.T) {
+	projects_dir := useTestProjects(t)
+	smtp_server := newTestSmtpServer(t)
+	host, port, _ := net.SplitHostPort(smtp_server.listener.Addr().String())
+	config.Notifications.BaseUrl = "http://greendots.test"
+	config.Notifications.Smtp = smtpConfig{Host: host, From: "greendots@example.com"}
+	config.Notifications.Smtp.Port, _ = strconv.Atoi(port)
+
+	project := "digest"
+	now := time.Now()
+	writeTestRun(t, project, "run-1", now.Add(-2*time.Hour), map[string]string{"test_a": "passed", "test_b": "passed"})
+	writeTestRun(t, project, "run-2", now.Add(-1*time.Hour), map[string]string{"test_a": "passed", "test_b": "failed"})
+	// Only the first owner is valid, the others would smuggle in headers or aren't an address
+	metadata := "owners = [\"Dev <dev@example.com>\", \"ops@example.com\\r\\nBcc: evil@example.com\", \"nobody\"]\n"
+	err := os.WriteFile(filepath.Join(projects_dir, project, "metadata.toml"), []byte(metadata), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := loadDigestsState()
+	if !sendDigests(&state, "2024-01-02") {
+		t.Fatal("sending the digests failed")
+	}
+	emails := smtp_server.received()
+	if len(emails) != 1 {
+		t.Fatalf("%d emails, expected 1", len(emails))
+	}
+	email := emails[0]
+	if email.from != "greendots@example.com" || strings.Join(email.to, ",") != "dev@example.com" {
+		t.Fatalf("unexpected envelope: %s to %v", email.from, email.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(email.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{
+		"From":         "greendots@example.com",
+		"To":           "dev@example.com",
+		"Subject":      "Greendots daily digest",
+		"Content-Type": "text/plain; charset=utf-8",
+	}
+	for name, value := range headers {
+		if msg.Header.Get(name) != value {
+			t.Errorf("%s header is %q, expected %q", name, msg.Header.Get(name), value)
+		}
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Errorf("unexpected Bcc header: %q", msg.Header.Get("Bcc"))
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("invalid Date header: %v", err)
+	}
+
+	body := email.data[strings.Index(email.data, "\r\n\r\n")+4:]
+	for _, expected := range []string{
+		"== digest ==\r\nhttp://greendots.test/digest\r\n",
+		"Runs in the last day: 2\r\n",
+		"  run-2 (finished: 1 passed, 1 failed, 0 error, 0 skipped)\r\n    http://greendots.test/digest/run-2\r\n",
+		"New failures: 1\r\n  test_b (in run-2)\r\n    AssertionError: test_b\r\n",
+		"Pass rate of the last 7 days, oldest first: - - - - - - 75.0%\r\n",
+		"Flaky tests in the last 2 runs: 1\r\n  test_b (score 0.50, 1 flips, 0 reruns)\r\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("the body doesn't contain %q:\n%s", expected, body)
+		}
+	}
+
+	// Each owner gets one digest per day, even after a restart
+	state = loadDigestsState()
+	if state.Sent["dev@example.com"] != "2024-01-02" {
+		t.Fatalf("unexpected saved state: %v", state.Sent)
+	}
+	if !sendDigests(&state, "2024-01-02") {
+		t.Fatal("sending the digests again failed")
+	}
+	if len(smtp_server.received()) != 1 {
+		t.Fatal("the digest was sent twice on the same day")
+	}
+	if !sendDigests(&state, "2024-01-03") {
+		t.Fatal("sending the next digests failed")
+	}
+	if len(smtp_server.received()) != 2 {
+		t.Fatal("the digest of the next day wasn't sent")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// -- Test durations --
+//
+// The slowest tests of a run, and the tests that got slower than they used to
+// be: a passed test regressed when it took more than `regression_factor`
+// times its median duration in the `baseline_runs` runs before it (counting
+// only the runs it passed in).
+
+const durationsMaxSlowest = 1000
+
+// A regression is only flagged when the test passed in at least this many of the baseline runs
+const durationsMinSamples = 3
+
+type testDuration struct {
+	Test     string  `json:"test"`
+	Outcome  string  `json:"outcome"`
+	Duration float64 `json:"duration"`
+	Setup    float64 `json:"setup"`
+	Call     float64 `json:"call"`
+	Teardown float64 `json:"teardown"`
+	// The median duration in the baseline runs, zero if the test has no baseline
+	BaselineMedian  float64 `json:"baseline_median"`
+	BaselineSamples int     `json:"baseline_samples"`
+	// Duration / BaselineMedian
+	Factor    float64 `json:"factor"`
+	Regressed bool    `json:"regressed"`
+}
+
+type runDurations struct {
+	Run          string         `json:"run"`
+	BaselineRuns []string       `json:"baseline_runs"`
+	Slowest      []testDuration `json:"slowest"`
+	Regressions  []testDuration `json:"regressions"`
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// Returns the durations of the passed tests in the runs before `run_id`, by test
+func getBaselineDurations(project string, runs []run, run_id string) ([]string, map[string][]float64) {
+	baseline_runs := []string{}
+	durations := make(map[string][]float64)
+
+	index := slices.IndexFunc(runs, func(r run) bool { return r.Id == run_id })
+	if index < 0 {
+		return baseline_runs, durations
+	}
+	for _, r := range runs[index+1 : min(index+1+config.Durations.BaselineRuns, len(runs))] {
+		created, err := time.Parse(time.RFC3339, r.CreatedAt)
+		if err != nil {
+			created = time.Time{}
+		}
+		results, err := getRunTestResults(project, r.Id, created)
+		if err != nil {
+			continue
+		}
+		baseline_runs = append(baseline_runs, r.Id)
+		for test, result := range results {
+			if result.Outcome == "passed" && result.Duration > 0 {
+				durations[test] = append(durations[test], result.Duration)
+			}
+		}
+	}
+	return baseline_runs, durations
+}
+
+func computeRunDurations(results map[string]testResult, baseline map[string][]float64) ([]testDuration, []testDuration) {
+	tests := []testDuration{}
+	regressions := []testDuration{}
+	for test, result := range results {
+		if result.Duration <= 0 {
+			continue
+		}
+		entry := testDuration{
+			Test:            test,
+			Outcome:         result.Outcome,
+			Duration:        result.Duration,
+			Setup:           result.Setup,
+			Call:            result.Call,
+			Teardown:        result.Teardown,
+			BaselineMedian:  median(baseline[test]),
+			BaselineSamples: len(baseline[test]),
+		}
+		if entry.BaselineMedian > 0 {
+			entry.Factor = entry.Duration / entry.BaselineMedian
+		}
+		entry.Regressed = result.Outcome == "passed" &&
+			entry.BaselineSamples >= min(durationsMinSamples, config.Durations.BaselineRuns) &&
+			entry.Duration >= config.Durations.MinDuration &&
+			entry.Factor > config.Durations.RegressionFactor
+		tests = append(tests, entry)
+		if entry.Regressed {
+			regressions = append(regressions, entry)
+		}
+	}
+
+	sort.Slice(tests, func(i int, j int) bool {
+		if tests[i].Duration != tests[j].Duration {
+			return tests[i].Duration > tests[j].Duration
+		}
+		return tests[i].Test < tests[j].Test
+	})
+	sort.Slice(regressions, func(i int, j int) bool {
+		if regressions[i].Factor != regressions[j].Factor {
+			return regressions[i].Factor > regressions[j].Factor
+		}
+		return regressions[i].Test < regressions[j].Test
+	})
+	return tests, regressions
+}
+
+func runDurationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	run_id := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run_id) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	limit, ok := parseLimitQuery(r, config.Durations.SlowestCount, durationsMaxSlowest)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	runs, err := getProjectRuns(project)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	results, err := getListedRunTestResults(project, run_id)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	baseline_runs, baseline := getBaselineDurations(project, runs, run_id)
+	slowest, regressions := computeRunDurations(results, baseline)
+	result := runDurations{
+		Run:          run_id,
+		BaselineRuns: baseline_runs,
+		Slowest:      slowest[:min(limit, len(slowest))],
+		Regressions:  regressions,
+	}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
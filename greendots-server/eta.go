@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// -- ETA --
+//
+// The remaining time of a run is estimated from the median duration of each
+// test in the previous runs (the same baseline as the duration regressions,
+// see durations.go). Tests without any history are expected to take the
+// average of the others, or of the tests that finished in this run if no test
+// has any history. Running tests are expected to take what's left of
+// their duration, or of their `progress` when they report it, and the tests
+// that didn't start yet are handed out in order to whichever worker is free
+// first, like xdist does.
+//
+// The baseline of a run doesn't change while it runs, so the expected
+// durations are kept for `eta_baseline_cache_ms`, and only the position of
+// the workers is looked at again for every ETA.
+
+type testEta struct {
+	Test   string `json:"test"`
+	Worker int    `json:"worker"`
+	// Seconds
+	Expected  float64 `json:"expected"`
+	Elapsed   float64 `json:"elapsed"`
+	Remaining float64 `json:"remaining"`
+	// From the last `progress` status of the test, nil if it didn't report any
+	Progress *float64 `json:"progress"`
+}
+
+type runEta struct {
+	// Seconds until the run is expected to finish
+	Remaining    float64   `json:"remaining"`
+	EstimatedEnd time.Time `json:"estimated_end"`
+	// Tests left to run, and how many of them have no history to go by
+	TestsLeft      int `json:"tests_left"`
+	WithoutHistory int `json:"without_history"`
+}
+
+type runEtaReport struct {
+	runEta
+	// The tests that are running right now
+	Tests []testEta `json:"tests"`
+}
+
+type etaBaselineCacheVal struct {
+	expected  map[string]float64
+	fallback  float64
+	expiresAt time.Time
+}
+
+var etaBaselineCache = struct {
+	sync.Mutex
+	entries map[runPlanCacheKey]etaBaselineCacheVal
+}{entries: make(map[runPlanCacheKey]etaBaselineCacheVal)}
+
+// Returns the expected duration of each test, from the median of its durations in the baseline runs
+func getExpectedDurations(project string, runs []run, run_id string) (map[string]float64, float64) {
+	_, baseline := getBaselineDurations(project, runs, run_id)
+	expected := make(map[string]float64, len(baseline))
+	total := 0.0
+	for test, durations := range baseline {
+		expected[test] = median(durations)
+		total += expected[test]
+	}
+	fallback := 0.0
+	if len(expected) > 0 {
+		fallback = total / float64(len(expected))
+	}
+	return expected, fallback
+}
+
+func computeRunEta(plan *runPlan, snapshots []statusSnapshot, expected map[string]float64, fallback float64, now time.Time) runEtaReport {
+	report := runEtaReport{Tests: []testEta{}}
+	if fallback == 0 {
+		total, count := 0.0, 0
+		for _, snapshot := range snapshots {
+			for _, test := range snapshot.Timeline {
+				if test.End != 0 {
+					total += test.End - test.Start
+					count++
+				}
+			}
+		}
+		if count > 0 {
+			fallback = total / float64(count)
+		}
+	}
+	expectedDuration := func(test string) float64 {
+		if duration, ok := expected[test]; ok {
+			return duration
+		}
+		report.WithoutHistory++
+		return fallback
+	}
+
+	// When each worker is expected to be done with its running test
+	free_at := make([]float64, len(snapshots))
+	running := make(map[string]bool)
+	for worker_id, snapshot := range snapshots {
+		if len(snapshot.Timeline) == 0 {
+			continue
+		}
+		last := snapshot.Timeline[len(snapshot.Timeline)-1]
+		status_obj := snapshot.Statuses[last.Test]
+		if last.End != 0 || status_obj["type"] == "finish" {
+			continue
+		}
+		running[last.Test] = true
+		report.TestsLeft++
+
+		// The last write on the worker's own clock, plus the time since then on ours
+		entry := testEta{
+			Test:     last.Test,
+			Worker:   worker_id,
+			Expected: expectedDuration(last.Test),
+			Elapsed:  max(snapshot.LastTime-last.Start+now.Sub(snapshot.ModTime).Seconds(), 0),
+		}
+		if percentage, ok := status_obj["percentage"].(float64); ok && status_obj["type"] == "progress" {
+			entry.Progress = &percentage
+		}
+		switch {
+		case entry.Progress != nil && *entry.Progress > 0:
+			// Extrapolate from the progress so far
+			entry.Remaining = entry.Elapsed / *entry.Progress * (1 - *entry.Progress)
+		default:
+			entry.Remaining = max(entry.Expected-entry.Elapsed, 0)
+		}
+		free_at[worker_id] = entry.Remaining
+		report.Tests = append(report.Tests, entry)
+	}
+	sort.Slice(report.Tests, func(i int, j int) bool {
+		return report.Tests[i].Worker < report.Tests[j].Worker
+	})
+
+	group_names := make([]string, 0, len(plan.Groups))
+	for group_name := range plan.Groups {
+		group_names = append(group_names, group_name)
+	}
+	sort.Strings(group_names)
+	for _, group_name := range group_names {
+		for _, test_item := range plan.Groups[group_name] {
+			if running[test_item.Id] || slices.ContainsFunc(snapshots, func(snapshot statusSnapshot) bool {
+				_, ok := snapshot.Statuses[test_item.Id]
+				return ok
+			}) {
+				continue
+			}
+			report.TestsLeft++
+			if len(free_at) == 0 {
+				continue
+			}
+			worker_id := 0
+			for i := range free_at {
+				if free_at[i] < free_at[worker_id] {
+					worker_id = i
+				}
+			}
+			free_at[worker_id] += expectedDuration(test_item.Id)
+		}
+	}
+
+	for _, worker_free_at := range free_at {
+		report.Remaining = max(report.Remaining, worker_free_at)
+	}
+	report.EstimatedEnd = now.Add(time.Duration(report.Remaining * float64(time.Second))).UTC().Truncate(time.Second)
+	return report
+}
+
+// Same as getExpectedDurations, but cached, see above
+func getCachedExpectedDurations(project string, run_id string) (map[string]float64, float64, error) {
+	key := runPlanCacheKey{project, run_id}
+	now := time.Now()
+	etaBaselineCache.Lock()
+	val, ok := etaBaselineCache.entries[key]
+	etaBaselineCache.Unlock()
+	if ok && now.Before(val.expiresAt) {
+		return val.expected, val.fallback, nil
+	}
+
+	runs, err := getProjectRuns(project)
+	if err != nil {
+		return nil, 0, err
+	}
+	val.expected, val.fallback = getExpectedDurations(project, runs, run_id)
+	val.expiresAt = now.Add(time.Duration(config.Caching.EtaBaselineCacheMs) * time.Millisecond)
+
+	etaBaselineCache.Lock()
+	defer etaBaselineCache.Unlock()
+	for cached_key, cached := range etaBaselineCache.entries {
+		if !now.Before(cached.expiresAt) {
+			delete(etaBaselineCache.entries, cached_key)
+		}
+	}
+	etaBaselineCache.entries[key] = val
+	return val.expected, val.fallback, nil
+}
+
+func getRunEta(project string, run_id string) (runEtaReport, error) {
+	plan, err := getRunPlan(project, run_id)
+	if err != nil {
+		return runEtaReport{}, err
+	}
+	expected, fallback, err := getCachedExpectedDurations(project, run_id)
+	if err != nil {
+		return runEtaReport{}, err
+	}
+	return computeRunEta(plan, getStatusSnapshots(project, run_id, plan), expected, fallback, time.Now()), nil
+}
+
+func runEtaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	run_id := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run_id) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	report, err := getRunEta(project, run_id)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -- Server-Sent Events --
+//
+// A single stream with the initial status summary followed by every new status
+// line of every worker, replacing the status_summary -> status_poll ->
+// status_stream loop of the frontend. The id of each event is the list of
+// per-worker end offsets, so reconnecting with `Last-Event-ID` resumes exactly
+// where the previous connection stopped.
+
+type eventsSummary struct {
+	Statuses []map[string]interface{} `json:"statuses"`
+	Offsets  []int                    `json:"offsets"`
+}
+
+type eventsStatus struct {
+	WorkerId int             `json:"worker_id"`
+	Status   json.RawMessage `json:"status"`
+}
+
+func formatEventId(offsets []int) string {
+	parts := make([]string, len(offsets))
+	for i, offset := range offsets {
+		parts[i] = strconv.Itoa(offset)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseEventId(id string, worker_count int) ([]int, error) {
+	offsets := make([]int, worker_count)
+	if id == "" {
+		return offsets, nil
+	}
+	for i, part := range strings.Split(id, ",") {
+		if i >= worker_count {
+			return nil, fmt.Errorf("too many offsets")
+		}
+		offset, err := strconv.Atoi(part)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset '%s'", part)
+		}
+		offsets[i] = offset
+	}
+	return offsets, nil
+}
+
+func writeEvent(w http.ResponseWriter, event string, id string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return fullWrite(w, fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", id, event, encoded))
+}
+
+// Status lines are only checked to be valid JSON, they are sent as-is
+func parseTailStatusLine(line []byte) (interface{}, bool) {
+	return nil, json.Valid(line)
+}
+
+func runEventsHandler(w http.ResponseWriter, r *http.Request) {
+	done := r.Context().Done()
+
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// EventSource sends the header on reconnects, allow the query for other clients
+	last_event_id := r.Header.Get("Last-Event-ID")
+	if last_event_id == "" {
+		last_event_id = r.URL.Query().Get("last_event_id")
+	}
+	offsets, err := parseEventId(last_event_id, plan.WorkerCount)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// Send the initial summary, unless we are resuming
+	if last_event_id == "" {
+		statuses, indexes := getStatusSummary(project, run, plan)
+		summary := eventsSummary{Statuses: []map[string]interface{}{}, Offsets: indexes}
+		for _, res := range statuses {
+			for _, status_obj := range res {
+				summary.Statuses = append(summary.Statuses, status_obj)
+			}
+		}
+		err = writeEvent(w, "summary", formatEventId(indexes), summary)
+		if err != nil {
+			return
+		}
+		offsets = indexes
+	}
+	w.(http.Flusher).Flush()
+
+	// Report the tests that crash or hang from now on, see lost_tests.go
+	watches := make([]*lostTestsWatch, plan.WorkerCount)
+	for i, snapshot := range getStatusSnapshots(project, run, plan) {
+		watches[i] = newLostTestsWatch(i, snapshot)
+	}
+	writeLostStatus := func(worker_id int, status_obj map[string]interface{}) error {
+		data, err := json.Marshal(status_obj)
+		if err != nil {
+			return err
+		}
+		return writeEvent(w, "status", formatEventId(offsets), eventsStatus{WorkerId: worker_id, Status: data})
+	}
+
+	// Follow the shared tailers of all the status files, see tailer.go
+	subs := make([]*tailSubscription, plan.WorkerCount)
+	for i := range subs {
+		tailer, release := tailers.tail(project, run, statusFileName(i), "status", parseTailStatusLine, time.Duration(config.StatusPoll.SleepMs)*time.Millisecond)
+		defer release()
+		subs[i] = tailer.subscribe(int64(offsets[i]))
+		defer subs[i].Close()
+	}
+
+	keepalive := time.NewTicker(time.Duration(config.Events.KeepaliveMs) * time.Millisecond)
+	defer keepalive.Stop()
+	for {
+		changed := make([]<-chan struct{}, len(subs))
+		for i, sub := range subs {
+			changed[i] = sub.Changed()
+		}
+
+		wrote := false
+		more := false
+		for i, sub := range subs {
+			lines, sub_more, err := sub.Poll()
+			if err != nil {
+				log.Printf("%s %s: worker %d: %v", r.Method, r.URL.Path, i, err)
+				return
+			}
+			more = more || sub_more
+			for _, line := range lines {
+				if !line.Valid {
+					continue
+				}
+				offsets[i] = int(line.EndOffset)
+				err = writeEvent(w, "status", formatEventId(offsets), eventsStatus{WorkerId: i, Status: line.Data})
+				if err != nil {
+					return
+				}
+				if crashed := watches[i].line(project, run, line); crashed != nil {
+					err = writeLostStatus(i, crashed)
+					if err != nil {
+						return
+					}
+				}
+				wrote = true
+			}
+			// Lines that were skipped still count, so resuming doesn't see them again
+			offsets[i] = int(sub.Offset())
+		}
+
+		if wrote {
+			w.(http.Flusher).Flush()
+			keepalive.Reset(time.Duration(config.Events.KeepaliveMs) * time.Millisecond)
+		}
+
+		if more {
+			continue
+		}
+
+		// Wait for any of the status files to change
+		for !waitForChanges(changed, done, keepalive.C) {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// Keep proxies from closing an idle connection
+			err = fullWrite(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			for i, watch := range watches {
+				if hung := watch.check(project, run); hung != nil {
+					err = writeLostStatus(i, hung)
+					if err != nil {
+						return
+					}
+				}
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -- Failure clustering --
+//
+// The `exception` of a failed test is the `longreprtext` of its pytest report.
+// It is parsed into its frames and final error, and failures are clustered by
+// a signature made of the error type, the error message and the innermost
+// frame, with everything that tends to differ between similar failures
+// (numbers, addresses, temporary paths, ...) masked out.
+//
+// The "long", "short" and "native" traceback styles are supported. For
+// chained exceptions only the last one is parsed.
+
+type failureFrame struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Function string `json:"function,omitempty"`
+	Source   string `json:"source,omitempty"`
+}
+
+type parsedFailure struct {
+	Frames       []failureFrame `json:"frames"`
+	ErrorType    string         `json:"error_type"`
+	ErrorMessage string         `json:"error_message"`
+}
+
+type failureCluster struct {
+	Id        string `json:"id"`
+	Signature string `json:"signature"`
+	// Taken from the first test of the cluster
+	Example parsedFailure `json:"example"`
+	Tests   []string      `json:"tests"`
+	// The known issue of the first test of the cluster that matched one, see known_issues.go
+	KnownIssue *knownIssueMatch `json:"known_issue"`
+}
+
+type runFailures struct {
+	Clusters []failureCluster `json:"clusters"`
+}
+
+var (
+	// "path/to/file.py:12: in func" (short) or "path/to/file.py:12: ErrorType" (long)
+	tracebackLocationRegex = regexp.MustCompile(`^(\S[^:]*):(\d+):(?: (.*))?$`)
+	// `  File "path/to/file.py", line 12, in func` (native)
+	tracebackNativeRegex = regexp.MustCompile(`^\s*File "(.+)", line (\d+), in (.+)$`)
+	tracebackDefRegex    = regexp.MustCompile(`^\s*(?:async\s+)?def\s+(\w+)\s*\(`)
+	// "ErrorType: message" as the last line of a native traceback
+	tracebackErrorRegex   = regexp.MustCompile(`^([\w.]+)(?::\s*(.*))?$`)
+	tracebackChainMarkers = []string{
+		"The above exception was the direct cause of the following exception:",
+		"During handling of the above exception, another exception occurred:",
+	}
+)
+
+// Hex ids need at least one digit and one letter, in either order, so words like "deadbeef" are kept
+var (
+	maskTempPathRegex = regexp.MustCompile(`(?:/tmp|/var/tmp|/private/var/folders|/var/folders|[A-Za-z]:\\[^\s'"]*\\Temp)[^\s'":,)\]]*`)
+	maskUuidRegex     = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	maskAddressRegex  = regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`)
+	maskHexRegex      = regexp.MustCompile(`(?i)\b(?:[0-9a-f]*[0-9][0-9a-f]*[a-f]|[0-9a-f]*[a-f][0-9a-f]*[0-9])[0-9a-f]*\b`)
+	maskNumberRegex   = regexp.MustCompile(`\d+(?:\.\d+)?`)
+)
+
+// Masks the parts of a failure message that usually differ between similar failures
+func normalizeFailureText(text string) string {
+	text = maskTempPathRegex.ReplaceAllString(text, "<tmp>")
+	text = maskUuidRegex.ReplaceAllString(text, "<uuid>")
+	text = maskAddressRegex.ReplaceAllString(text, "<addr>")
+	text = maskHexRegex.ReplaceAllString(text, "<hex>")
+	text = maskNumberRegex.ReplaceAllString(text, "<n>")
+	return text
+}
+
+func stripErrorPrefix(line string) (string, bool) {
+	if line == "E" || strings.HasPrefix(line, "E ") {
+		return strings.TrimSpace(line[1:]), true
+	}
+	return "", false
+}
+
+func parseFailure(exception string) parsedFailure {
+	lines := strings.Split(strings.ReplaceAll(exception, "\r\n", "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if slices.Contains(tracebackChainMarkers, strings.TrimSpace(lines[i])) {
+			lines = lines[i+1:]
+			break
+		}
+	}
+
+	failure := parsedFailure{Frames: []failureFrame{}}
+	var error_lines []string
+	// Source lines of the current long style frame, until its location line
+	var pending []string
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if match := tracebackNativeRegex.FindStringSubmatch(line); match != nil {
+			frame := failureFrame{File: match[1], Function: match[3]}
+			frame.Line, _ = strconv.Atoi(match[2])
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "    ") {
+				frame.Source = strings.TrimSpace(lines[i+1])
+				i++
+			}
+			failure.Frames = append(failure.Frames, frame)
+			continue
+		}
+
+		if match := tracebackLocationRegex.FindStringSubmatch(line); match != nil {
+			frame := failureFrame{File: match[1]}
+			frame.Line, _ = strconv.Atoi(match[2])
+			message := match[3]
+			if function, ok := strings.CutPrefix(message, "in "); ok {
+				// Short style, the source line follows the location
+				frame.Function = function
+				if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "    ") {
+					frame.Source = strings.TrimSpace(lines[i+1])
+					i++
+				}
+			} else {
+				// Long style, the source precedes the location, and the failing line is marked with ">"
+				for _, source_line := range pending {
+					if match := tracebackDefRegex.FindStringSubmatch(source_line); match != nil && frame.Function == "" {
+						frame.Function = match[1]
+					}
+					if source, ok := strings.CutPrefix(source_line, ">"); ok {
+						frame.Source = strings.TrimSpace(source)
+					}
+				}
+				if message != "" {
+					failure.ErrorType = message
+				}
+			}
+			pending = nil
+			failure.Frames = append(failure.Frames, frame)
+			continue
+		}
+
+		if error_line, ok := stripErrorPrefix(line); ok {
+			// A new block of error lines, only the last one describes the final error
+			prev_is_error := false
+			if len(pending) > 0 {
+				_, prev_is_error = stripErrorPrefix(pending[len(pending)-1])
+			}
+			if !prev_is_error {
+				error_lines = nil
+			}
+			error_lines = append(error_lines, error_line)
+		}
+		pending = append(pending, line)
+	}
+
+	// The last line of a native traceback is the error itself
+	if len(error_lines) == 0 {
+		for i := len(lines) - 1; i >= 0; i-- {
+			last := strings.TrimSpace(lines[i])
+			if last == "" {
+				continue
+			}
+			if match := tracebackErrorRegex.FindStringSubmatch(last); match != nil && !strings.HasPrefix(lines[i], " ") {
+				if failure.ErrorType == "" {
+					failure.ErrorType = match[1]
+				}
+				failure.ErrorMessage = match[2]
+			} else {
+				failure.ErrorMessage = last
+			}
+			break
+		}
+		return failure
+	}
+
+	message := strings.Join(error_lines, "\n")
+	// Error lines of raised exceptions start with their type, assertion rewrites don't
+	if error_type, rest, ok := strings.Cut(error_lines[0], ": "); ok && tracebackErrorRegex.MatchString(error_type) {
+		if failure.ErrorType == "" || failure.ErrorType == error_type || strings.HasSuffix(error_type, "."+failure.ErrorType) {
+			failure.ErrorType = error_type
+			message = strings.Join(append([]string{rest}, error_lines[1:]...), "\n")
+		}
+	}
+	if failure.ErrorType == "" && strings.HasPrefix(message, "assert") {
+		// The short style doesn't mention the type of failed asserts
+		failure.ErrorType = "AssertionError"
+	}
+	failure.ErrorMessage = message
+	return failure
+}
+
+func failureSignature(failure parsedFailure) string {
+	// Only the first line of the message, the rest is usually a diff of values
+	message, _, _ := strings.Cut(failure.ErrorMessage, "\n")
+	signature := failure.ErrorType + ": " + normalizeFailureText(message)
+	if len(failure.Frames) > 0 {
+		frame := failure.Frames[len(failure.Frames)-1]
+		signature += " @ " + normalizeFailureText(frame.File) + ":" + frame.Function
+	}
+	return signature
+}
+
+func failureClusterId(signature string) string {
+	digest := sha1.Sum([]byte(signature))
+	return hex.EncodeToString(digest[:6])
+}
+
+// Clusters the failures of a run, largest clusters first
+func clusterRunFailures(plan *runPlan, snapshots []statusSnapshot, rules []compiledKnownIssueRule) []failureCluster {
+	clusters := make(map[string]*failureCluster)
+	for _, group := range plan.Groups {
+		for _, test_item := range group {
+			var status_obj map[string]interface{}
+			for _, snapshot := range snapshots {
+				if found, ok := snapshot.Statuses[test_item.Id]; ok {
+					status_obj = found
+					break
+				}
+			}
+			if status_obj == nil || status_obj["type"] != "finish" || status_obj["outcome"] == "passed" || status_obj["outcome"] == "skipped" {
+				continue
+			}
+			exception, ok := status_obj["exception"].(string)
+			if !ok {
+				continue
+			}
+
+			failure := parseFailure(exception)
+			signature := failureSignature(failure)
+			cluster, ok := clusters[signature]
+			if !ok {
+				cluster = &failureCluster{
+					Id:        failureClusterId(signature),
+					Signature: signature,
+					Example:   failure,
+					Tests:     []string{},
+				}
+				clusters[signature] = cluster
+			}
+			cluster.Tests = append(cluster.Tests, test_item.Id)
+			if cluster.KnownIssue == nil {
+				cluster.KnownIssue = matchKnownIssue(rules, test_item.Id, test_item.Params, exception)
+			}
+		}
+	}
+
+	result := make([]failureCluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		sort.Strings(cluster.Tests)
+		result = append(result, *cluster)
+	}
+	sort.Slice(result, func(i int, j int) bool {
+		if len(result[i].Tests) != len(result[j].Tests) {
+			return len(result[i].Tests) > len(result[j].Tests)
+		}
+		return result[i].Signature < result[j].Signature
+	})
+	return result
+}
+
+func runFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	_, rules := getKnownIssues(project)
+	result := runFailures{Clusters: clusterRunFailures(plan, getStatusSnapshots(project, run, plan), rules)}
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
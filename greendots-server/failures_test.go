@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeFailureText(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"expected 3 but got 42 after 1.5s", "expected <n> but got <n> after <n>s"},
+		// Hex ids, whichever of their digits or letters come first, but not plain words
+		{"worker ab12 failed", "worker <hex> failed"},
+		{"worker 12ab failed", "worker <hex> failed"},
+		{"commit 3f9c2e1d", "commit <hex>"},
+		{"deadbeef added", "deadbeef added"},
+		{"<Conn object at 0x7f3a2b10cd90>", "<Conn object at <addr>>"},
+		{"job 123e4567-e89b-12d3-a456-426614174000 timed out", "job <uuid> timed out"},
+		{"No such file: '/tmp/pytest-of-ci/pytest-7/test_x0/out.txt'", "No such file: '<tmp>'"},
+		{`C:\Users\ci\AppData\Local\Temp\pytest-3\x.txt is locked`, "<tmp> is locked"},
+	}
+	for _, c := range cases {
+		if normalized := normalizeFailureText(c.text); normalized != c.expected {
+			t.Errorf("%q normalized to %q, expected %q", c.text, normalized, c.expected)
+		}
+	}
+}
+
+func TestParseFailure(t *testing.T) {
+	cases := []struct {
+		name      string
+		exception string
+		expected  parsedFailure
+	}{
+		{
+			name: "long assert",
+			exception: `    def test_add():
+        x = 1
+>       assert add(x, 1) == 3
+E       assert 2 == 3
+E        +  where 2 = add(1, 1)
+
+tests/test_math.py:5: AssertionError`,
+			expected: parsedFailure{
+				Frames:       []failureFrame{{File: "tests/test_math.py", Line: 5, Function: "test_add", Source: "assert add(x, 1) == 3"}},
+				ErrorType:    "AssertionError",
+				ErrorMessage: "assert 2 == 3\n+  where 2 = add(1, 1)",
+			},
+		},
+		{
+			name: "long raise",
+			exception: `    def test_open():
+>       open_config("missing.toml")
+
+tests/test_cfg.py:10:
+_ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _ _
+
+    def open_config(path):
+>       raise FileNotFoundError(path)
+E       FileNotFoundError: missing.toml
+
+src/cfg.py:3: FileNotFoundError`,
+			expected: parsedFailure{
+				Frames: []failureFrame{
+					{File: "tests/test_cfg.py", Line: 10, Function: "test_open", Source: `open_config("missing.toml")`},
+					{File: "src/cfg.py", Line: 3, Function: "open_config", Source: "raise FileNotFoundError(path)"},
+				},
+				ErrorType:    "FileNotFoundError",
+				ErrorMessage: "missing.toml",
+			},
+		},
+		{
+			name: "short",
+			exception: `tests/test_x.py:7: in test_x
+    check(value)
+src/check.py:12: in check
+    raise ValueError(f"bad value {value}")
+E   ValueError: bad value 42`,
+			expected: parsedFailure{
+				Frames: []failureFrame{
+					{File: "tests/test_x.py", Line: 7, Function: "test_x", Source: "check(value)"},
+					{File: "src/check.py", Line: 12, Function: "check", Source: `raise ValueError(f"bad value {value}")`},
+				},
+				ErrorType:    "ValueError",
+				ErrorMessage: "bad value 42",
+			},
+		},
+		{
+			name: "native chained",
+			exception: `Traceback (most recent call last):
+  File "/app/db.py", line 10, in connect
+    sock.connect(addr)
+ConnectionRefusedError: [Errno 111] Connection refused
+
+The above exception was the direct cause of the following exception:
+
+Traceback (most recent call last):
+  File "/app/tests/test_db.py", line 4, in test_db
+    db.connect()
+  File "/app/db.py", line 12, in connect
+    raise DatabaseError("connection failed") from e
+db.DatabaseError: connection failed`,
+			expected: parsedFailure{
+				Frames: []failureFrame{
+					{File: "/app/tests/test_db.py", Line: 4, Function: "test_db", Source: "db.connect()"},
+					{File: "/app/db.py", Line: 12, Function: "connect", Source: `raise DatabaseError("connection failed") from e`},
+				},
+				ErrorType:    "db.DatabaseError",
+				ErrorMessage: "connection failed",
+			},
+		},
+		{
+			name: "long chained",
+			exception: `    def load():
+>       return json.loads(data)
+E       json.decoder.JSONDecodeError: Expecting value: line 1 column 1 (char 0)
+
+src/load.py:8: JSONDecodeError
+
+During handling of the above exception, another exception occurred:
+
+    def test_load():
+>       load()
+E       RuntimeError: invalid data at 0x7f3a2b10cd90
+
+tests/test_load.py:3: RuntimeError`,
+			expected: parsedFailure{
+				Frames:       []failureFrame{{File: "tests/test_load.py", Line: 3, Function: "test_load", Source: "load()"}},
+				ErrorType:    "RuntimeError",
+				ErrorMessage: "invalid data at 0x7f3a2b10cd90",
+			},
+		},
+	}
+	for _, c := range cases {
+		if failure := parseFailure(c.exception); !reflect.DeepEqual(failure, c.expected) {
+			t.Errorf("%s: parsed %+v, expected %+v", c.name, failure, c.expected)
+		}
+	}
+
+	// Failures that only differ by their temporary paths and ids share a signature
+	first := parseFailure("E   OSError: cannot remove /tmp/pytest-of-ci/pytest-1/a0 (job 4f2a9c)\n\nsrc/clean.py:4: OSError")
+	second := parseFailure("E   OSError: cannot remove /tmp/pytest-of-ci/pytest-2/b0 (job c0ffee9)\n\nsrc/clean.py:4: OSError")
+	if failureSignature(first) != failureSignature(second) {
+		t.Errorf("signatures differ: %q and %q", failureSignature(first), failureSignature(second))
+	}
+}
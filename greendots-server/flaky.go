@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// -- Flaky tests --
+//
+// A test is flaky when its outcome flips between runs of the same code, or
+// when it fails and then passes on a rerun within a run. Runs are compared
+// with the previous run of the same commit (the `commit_key` of the run
+// metadata), and runs without a commit are all compared with each other.
+// Only passes and failures (including errors) count, skips and unfinished
+// tests are ignored.
+//
+// The score of a test is the number of flips and reruns, divided by the
+// number of runs it passed or failed in.
+
+type flakyFlip struct {
+	FromRun     string `json:"from_run"`
+	FromOutcome string `json:"from_outcome"`
+	ToRun       string `json:"to_run"`
+	ToOutcome   string `json:"to_outcome"`
+	Commit      string `json:"commit,omitempty"`
+}
+
+type flakyTest struct {
+	Test         string      `json:"test"`
+	Score        float64     `json:"score"`
+	Observations int         `json:"observations"`
+	Flips        []flakyFlip `json:"flips"`
+	// Runs in which the test passed on a rerun
+	Reruns []string `json:"reruns"`
+}
+
+type flakyReport struct {
+	Runs  []string    `json:"runs"`
+	Tests []flakyTest `json:"tests"`
+}
+
+type flakyObservation struct {
+	run     string
+	outcome string
+}
+
+// Returns the commit of a run from its metadata, empty if it has none
+func getRunCommit(project string, run string) string {
+	metadata, err := getRunMetadata(project, run)
+	if err != nil {
+		return ""
+	}
+	commit, ok := metadata[config.Flaky.CommitKey]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(commit)
+}
+
+// Ranks the flaky tests of the given runs of a project, newest first as listed by getProjectRuns
+func getFlakyReport(project string, runs []run) flakyReport {
+	// Oldest first, so flips are reported in the order they happened
+	runs = slices.Clone(runs)
+	slices.Reverse(runs)
+
+	report := flakyReport{Runs: []string{}, Tests: []flakyTest{}}
+	tests := make(map[string]*flakyTest)
+	// The last observation of each test, by commit
+	last := make(map[string]map[string]flakyObservation)
+	for _, run := range runs {
+		created, err := time.Parse(time.RFC3339, run.CreatedAt)
+		if err != nil {
+			created = time.Time{}
+		}
+		results, err := getRunTestResults(project, run.Id, created)
+		if err != nil {
+			continue
+		}
+		report.Runs = append(report.Runs, run.Id)
+		commit := getRunCommit(project, run.Id)
+
+		for test, result := range results {
+			if result.Outcome != "passed" && result.Outcome != "failed" && result.Outcome != "error" {
+				continue
+			}
+			flaky, ok := tests[test]
+			if !ok {
+				flaky = &flakyTest{Test: test, Flips: []flakyFlip{}, Reruns: []string{}}
+				tests[test] = flaky
+				last[test] = make(map[string]flakyObservation)
+			}
+			flaky.Observations++
+
+			if result.PassedOnRerun {
+				flaky.Reruns = append(flaky.Reruns, run.Id)
+			}
+			prev, ok := last[test][commit]
+			if ok && (prev.outcome == "passed") != (result.Outcome == "passed") {
+				flaky.Flips = append(flaky.Flips, flakyFlip{
+					FromRun:     prev.run,
+					FromOutcome: prev.outcome,
+					ToRun:       run.Id,
+					ToOutcome:   result.Outcome,
+					Commit:      commit,
+				})
+			}
+			last[test][commit] = flakyObservation{run: run.Id, outcome: result.Outcome}
+		}
+	}
+
+	for _, flaky := range tests {
+		events := len(flaky.Flips) + len(flaky.Reruns)
+		if events == 0 {
+			continue
+		}
+		flaky.Score = float64(events) / float64(flaky.Observations)
+		report.Tests = append(report.Tests, *flaky)
+	}
+	sort.Slice(report.Tests, func(i int, j int) bool {
+		a, b := report.Tests[i], report.Tests[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Observations != b.Observations {
+			return a.Observations > b.Observations
+		}
+		return a.Test < b.Test
+	})
+	return report
+}
+
+func flakyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	if isDirTraversal(project) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	limit, ok := parseLimitQuery(r, config.History.DefaultRuns, config.History.MaxRuns)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	runs, err := getProjectRuns(project)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	report := getFlakyReport(project, runs[:min(limit, len(runs))])
+
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
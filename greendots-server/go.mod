@@ -2,5 +2,12 @@ module github.com/wazzaps/greendots
 
 go 1.22.5
 
-require github.com/andanhm/go-prettytime v1.1.0 // indirect
-require github.com/BurntSushi/toml v1.4.0 // indirect
+require github.com/andanhm/go-prettytime v1.1.0
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/klauspost/compress v1.17.11
+)
+
+require golang.org/x/sys v0.4.0 // indirect
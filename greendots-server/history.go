@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// -- Test history --
+
+type testHistoryEntry struct {
+	RunId     string `json:"run_id"`
+	CreatedAt string `json:"created_at"`
+	testResult
+	// The frontend page showing the log of the test in that run
+	LogUrl string `json:"log_url"`
+}
+
+type testHistory struct {
+	Test string             `json:"test"`
+	Runs []testHistoryEntry `json:"runs"`
+}
+
+// Returns the `limit` query parameter, or the default if it's missing
+func parseLimitQuery(r *http.Request, default_limit int, max_limit int) (int, bool) {
+	if !r.URL.Query().Has("limit") {
+		return default_limit, true
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	return min(limit, max_limit), true
+}
+
+func testLogUrl(project string, run string, test string) string {
+	return "/" + url.PathEscape(project) + "/" + url.PathEscape(run) + "/" + url.PathEscape(test)
+}
+
+func testHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	test := r.PathValue("test")
+	if isDirTraversal(project) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	limit, ok := parseLimitQuery(r, config.History.DefaultRuns, config.History.MaxRuns)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	runs, err := getProjectRuns(project)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	runs = runs[:min(limit, len(runs))]
+
+	// Runs that didn't plan the test are left out
+	result := testHistory{Test: test, Runs: []testHistoryEntry{}}
+	for _, run := range runs {
+		created, err := time.Parse(time.RFC3339, run.CreatedAt)
+		if err != nil {
+			created = time.Time{}
+		}
+		tests, err := getRunTestResults(project, run.Id, created)
+		if err != nil {
+			continue
+		}
+		test_result, ok := tests[test]
+		if !ok {
+			continue
+		}
+		result.Runs = append(result.Runs, testHistoryEntry{
+			RunId:      run.Id,
+			CreatedAt:  run.CreatedAt,
+			testResult: test_result,
+			LogUrl:     testLogUrl(project, run.Id, test),
+		})
+	}
+
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// -- Push ingestion --
+//
+// These handlers let remote runners push the same files the pytest plugin
+// writes into `projects_dir`, so the readers above keep working unchanged.
+
+// Serializes appends to the same file, so concurrent requests never interleave
+// partial lines (keyed by the full file path)
+var ingestFileLocks sync.Map
+
+func lockIngestFile(path string) func() {
+	mu, _ := ingestFileLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+func bearerAuthorized(r *http.Request, tokens []string) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return false
+	}
+	for _, allowed := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Logs are appended to as-is, so they must never be one of the other files of
+// the run (the plan, status files, end marker or metadata)
+func isIngestLogFile(name string) bool {
+	return len(name) > len(".log.jsonl") && strings.HasSuffix(name, ".log.jsonl") && !isDirTraversal(name)
+}
+
+// The status of a request whose body couldn't be read or isn't valid
+func ingestBodyStatus(err error) int {
+	if errors.As(err, new(*http.MaxBytesError)) {
+		// Over `max_body_bytes`
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Wraps an ingestion handler with the token check and the body size limit
+func ingestAuth(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(config.Ingest.Tokens) == 0 {
+			// Ingestion is disabled unless at least one token is configured
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if _, ok := storage.(*fsStorage); !ok {
+			// Pushed runs are written into `projects_dir`, other backends could never read them back
+			http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+			return
+		}
+		if !bearerAuthorized(r, config.Ingest.Tokens) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, config.Ingest.MaxBodyBytes)
+		handler(w, r)
+	}
+}
+
+// Reads a JSON-Lines request body, validating every line with `validate`.
+// The result always ends with a newline, so readers never see a partial object.
+func readIngestLines(r *http.Request, validate func(line []byte) error) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			// Empty lines would stop the status summary scanner early
+			continue
+		}
+		if validate != nil {
+			if err := validate(line); err != nil {
+				return nil, err
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func validateStatusLine(line []byte) error {
+	var status_obj map[string]interface{}
+	err := json.Unmarshal(line, &status_obj)
+	if err != nil {
+		return fmt.Errorf("invalid status line: %w", err)
+	}
+	if _, ok := status_obj["test"].(string); !ok {
+		return fmt.Errorf("status line without a 'test' field")
+	}
+	if _, ok := status_obj["type"].(string); !ok {
+		return fmt.Errorf("status line without a 'type' field")
+	}
+	return nil
+}
+
+func appendIngestFile(path string, data []byte) (int64, error) {
+	unlock := lockIngestFile(path)
+	defer unlock()
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	err = fullWriteBytes(fd, data)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+type ingestAppendResponse struct {
+	EndOffset int64 `json:"end_offset"`
+}
+
+func writeIngestAppendResponse(w http.ResponseWriter, r *http.Request, end_offset int64) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ingestAppendResponse{EndOffset: end_offset})
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+func ingestPlanHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(ingestBodyStatus(err)), ingestBodyStatus(err))
+		return
+	}
+
+	// Make sure the plan is something the readers can handle before storing it as-is
+	var plan runPlan
+	err = json.Unmarshal(body, &plan)
+	if err != nil || plan.WorkerCount <= 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	for _, group := range plan.Groups {
+		for _, test_item := range group {
+			if test_item.Id == "" || !isIngestLogFile(test_item.LogFile) {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	err = replaceIngestFile(project, run, "plan.json", body, true)
+	if err != nil {
+		log.Printf("%s %s: write plan: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	runPlanCache.invalidate(runPlanCacheKey{project, run})
+	forgetFinishedRun(project, run)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Writes a whole run file through a temporary file, so readers never see a partial one
+func replaceIngestFile(project string, run string, name string, data []byte, create bool) error {
+	runPath := filepath.Join(config.ProjectsDir, project, run)
+	if create {
+		err := os.MkdirAll(runPath, 0o755)
+		if err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(runPath, name)
+	unlock := lockIngestFile(path)
+	defer unlock()
+	tmpFd, err := os.CreateTemp(runPath, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFd.Name())
+	err = fullWriteBytes(tmpFd, data)
+	if closeErr := tmpFd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFd.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFd.Name(), path)
+	}
+	return err
+}
+
+// Marks a run as finished, see run_state.go
+func ingestEndHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if _, err := getRunPlan(project, run); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(ingestBodyStatus(err)), ingestBodyStatus(err))
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		body = []byte("{}")
+	}
+	var end_obj map[string]interface{}
+	if json.Unmarshal(body, &end_obj) != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	err = replaceIngestFile(project, run, runEndMarker, body, false)
+	if err != nil {
+		log.Printf("%s %s: write end marker: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	forgetFinishedRun(project, run)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ingestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// The plan must be pushed first, since it decides how many status files are read
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	worker_id, err := strconv.Atoi(r.PathValue("worker_id"))
+	if err != nil || worker_id < 0 || worker_id >= plan.WorkerCount {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	data, err := readIngestLines(r, validateStatusLine)
+	if err != nil {
+		http.Error(w, err.Error(), ingestBodyStatus(err))
+		return
+	}
+
+	statusPath := filepath.Join(config.ProjectsDir, project, run, fmt.Sprintf("status.%d.jsonl", worker_id))
+	end_offset, err := appendIngestFile(statusPath, data)
+	if err != nil {
+		log.Printf("%s %s: append status: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeIngestAppendResponse(w, r, end_offset)
+}
+
+func ingestLogHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	test := r.PathValue("test")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	logFile, err := getTestLogFile(project, run, test)
+	if err != nil || !isIngestLogFile(logFile) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Log lines that aren't valid JSON are shown as-is by the readers, so only split them
+	data, err := readIngestLines(r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), ingestBodyStatus(err))
+		return
+	}
+
+	logPath := filepath.Join(config.ProjectsDir, project, run, logFile)
+	end_offset, err := appendIngestFile(logPath, data)
+	if err != nil {
+		log.Printf("%s %s: append log: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	writeIngestAppendResponse(w, r, end_offset)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// -- JUnit XML export --
+//
+// A run as a JUnit XML report: a testsuite for each group of the plan, and a
+// testcase for each test item with its final status. Failures carry the
+// exception, skips their reason, and every testcase embeds its log as
+// system-out. The report is streamed one testcase at a time, so only the
+// statuses of the run are kept in memory.
+
+type junitCounts struct {
+	tests    int
+	failures int
+	errors   int
+	skipped  int
+	time     float64
+}
+
+func (counts *junitCounts) add(result testResult) {
+	counts.tests++
+	switch result.Outcome {
+	case "failed":
+		counts.failures++
+	case "error", testOutcomeRunning:
+		counts.errors++
+	case "skipped", testOutcomeNotStarted:
+		counts.skipped++
+	}
+	counts.time += result.Duration
+}
+
+func (counts *junitCounts) attrs(name string) []xml.Attr {
+	return []xml.Attr{
+		{Name: xml.Name{Local: "name"}, Value: name},
+		{Name: xml.Name{Local: "tests"}, Value: strconv.Itoa(counts.tests)},
+		{Name: xml.Name{Local: "failures"}, Value: strconv.Itoa(counts.failures)},
+		{Name: xml.Name{Local: "errors"}, Value: strconv.Itoa(counts.errors)},
+		{Name: xml.Name{Local: "skipped"}, Value: strconv.Itoa(counts.skipped)},
+		{Name: xml.Name{Local: "time"}, Value: strconv.FormatFloat(counts.time, 'f', 3, 64)},
+	}
+}
+
+// XML 1.0 can't hold most control characters, even escaped
+func junitText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || (r >= 0x20 && r != utf8.RuneError && r != 0xFFFE && r != 0xFFFF) {
+			return r
+		}
+		return '?'
+	}, text)
+}
+
+// Strips the module from a pytest node id ("module.py::Class::test[x]" to "Class::test[x]")
+func junitCaseName(test_id string) string {
+	_, name, found := strings.Cut(test_id, "::")
+	if !found {
+		return test_id
+	}
+	return name
+}
+
+func writeJunitElement(enc *xml.Encoder, name string, attrs []xml.Attr, text string) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}, Attr: attrs}
+	err := enc.EncodeToken(start)
+	if err == nil && text != "" {
+		err = enc.EncodeToken(xml.CharData(junitText(text)))
+	}
+	if err == nil {
+		err = enc.EncodeToken(start.End())
+	}
+	return err
+}
+
+// Writes the log of a test as plain text, only its last `max_bytes` if that's not 0
+func writeJunitLog(enc *xml.Encoder, project string, run string, test_item runPlanTestItem, max_bytes int64) error {
+	if isDirTraversal(test_item.LogFile) {
+		return nil
+	}
+	log_fd, err := openLogFile(project, run, test_item.LogFile)
+	if err != nil {
+		return nil
+	}
+	defer log_fd.Close()
+
+	start := xml.StartElement{Name: xml.Name{Local: "system-out"}}
+	err = enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	truncated := false
+	if max_bytes > 0 {
+		offset, err := log_fd.Seek(-max_bytes, io.SeekEnd)
+		truncated = err == nil && offset > 0
+		if !truncated {
+			_, err = log_fd.Seek(0, io.SeekStart)
+			if err != nil {
+				return enc.EncodeToken(start.End())
+			}
+		}
+	}
+
+	reader := bufio.NewReader(log_fd)
+	if truncated {
+		// Skip the first line, it's probably cut in the middle
+		reader.ReadBytes('\n')
+		err = enc.EncodeToken(xml.CharData("-- LOG TRUNCATED --\n"))
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		json_line, read_err := reader.ReadBytes('\n')
+		json_line = bytes.TrimRight(json_line, "\n")
+		if len(json_line) > 0 {
+			log_line, valid := parseJsonLogLine(json_line)
+			line := log_line.Message
+			if valid {
+				line = fmt.Sprintf("%s %s: %s", log_line.Level, log_line.Name, log_line.Message)
+			}
+			err = enc.EncodeToken(xml.CharData(junitText(line + "\n")))
+			if err != nil {
+				return err
+			}
+		}
+		if read_err != nil {
+			break
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+func writeJunitCase(enc *xml.Encoder, project string, run string, group string, test_item runPlanTestItem, result testResult, status_obj map[string]interface{}, max_log_bytes int64) error {
+	start := xml.StartElement{
+		Name: xml.Name{Local: "testcase"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "classname"}, Value: group},
+			{Name: xml.Name{Local: "name"}, Value: junitCaseName(test_item.Id)},
+			{Name: xml.Name{Local: "time"}, Value: strconv.FormatFloat(result.Duration, 'f', 3, 64)},
+		},
+	}
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	exception, _ := status_obj["exception"].(string)
+	reason, _ := status_obj["reason"].(string)
+	message := func(text string) []xml.Attr {
+		return []xml.Attr{{Name: xml.Name{Local: "message"}, Value: junitText(text)}}
+	}
+	switch result.Outcome {
+	case "failed":
+		err = writeJunitElement(enc, "failure", message(result.ExceptionTitle), exception)
+	case "error":
+		err = writeJunitElement(enc, "error", message(result.ExceptionTitle), exception)
+	case "skipped":
+		err = writeJunitElement(enc, "skipped", message(reason), "")
+	case testOutcomeRunning:
+		err = writeJunitElement(enc, "error", message("The test didn't finish"), "")
+	case testOutcomeNotStarted:
+		err = writeJunitElement(enc, "skipped", message("The test didn't start"), "")
+	}
+	if err == nil && result.Outcome != testOutcomeNotStarted {
+		err = writeJunitLog(enc, project, run, test_item, max_log_bytes)
+	}
+	if err == nil {
+		err = enc.EncodeToken(start.End())
+	}
+	return err
+}
+
+func runJunitHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	max_log_bytes := config.Junit.MaxLogBytes
+	if r.URL.Query().Get("max_log_bytes") != "" {
+		var err error
+		max_log_bytes, err = strconv.ParseInt(r.URL.Query().Get("max_log_bytes"), 10, 64)
+		if err != nil || max_log_bytes < 0 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	snapshots := getStatusSnapshots(project, run, plan)
+	results := computeTestResults(plan, snapshots)
+	// The exception or reason of each result, from the same status it came from
+	statuses := make(map[string]map[string]interface{})
+	for _, test_items := range plan.Groups {
+		for _, test_item := range test_items {
+			worker_id, status_obj := findTestStatus(snapshots, test_item.Id)
+			if lost := results[test_item.Id].Lost; lost != "" {
+				status_obj = lostTestStatus(project, run, worker_id, test_item.Id, lost, status_obj)
+			}
+			statuses[test_item.Id] = status_obj
+		}
+	}
+
+	// The totals go in the attributes, so they're counted before streaming anything
+	groups := make([]string, 0, len(plan.Groups))
+	group_counts := make(map[string]*junitCounts)
+	total := junitCounts{}
+	for group, test_items := range plan.Groups {
+		groups = append(groups, group)
+		counts := &junitCounts{}
+		for _, test_item := range test_items {
+			counts.add(results[test_item.Id])
+			total.add(results[test_item.Id])
+		}
+		group_counts[group] = counts
+	}
+	sort.Strings(groups)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.junit.xml\"", strings.ReplaceAll(run, "\"", "_")))
+	err = fullWrite(w, xml.Header)
+	if err != nil {
+		return
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	suites := xml.StartElement{Name: xml.Name{Local: "testsuites"}, Attr: total.attrs(run)}
+	err = enc.EncodeToken(suites)
+	for _, group := range groups {
+		if err != nil {
+			break
+		}
+		suite := xml.StartElement{Name: xml.Name{Local: "testsuite"}, Attr: group_counts[group].attrs(group)}
+		err = enc.EncodeToken(suite)
+		for _, test_item := range plan.Groups[group] {
+			if err != nil {
+				break
+			}
+			err = writeJunitCase(enc, project, run, group, test_item, results[test_item.Id], statuses[test_item.Id], max_log_bytes)
+			if err == nil {
+				err = enc.Flush()
+			}
+			if err == nil {
+				w.(http.Flusher).Flush()
+			}
+		}
+		if err == nil {
+			err = enc.EncodeToken(suite.End())
+		}
+	}
+	if err == nil {
+		err = enc.EncodeToken(suites.End())
+	}
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		log.Printf("%s %s: xml encoder: %v", r.Method, r.URL.Path, err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// -- JUnit XML import --
+//
+// Turns a JUnit XML report of any test framework into a run, as if the pytest
+// plugin wrote it: a `plan.json` with a group for each testsuite, a
+// `status.0.jsonl` with made up statuses (the tests are laid out one after
+// the other from the testsuite timestamp), a log for each test from its
+// system-out and system-err, and an end marker. The params of each test are
+// parsed out of its name by the named groups of `params_regex`, e.g. the
+// default one turns "test_name[x86-1]" into "test_name" with {"param": "x86-1"}.
+
+const junitImportGroup = "junit"
+
+var errJunitRunExists = errors.New("the run already exists")
+
+type junitXmlResult struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitXmlCase struct {
+	Name      string           `xml:"name,attr"`
+	Classname string           `xml:"classname,attr"`
+	Time      string           `xml:"time,attr"`
+	Failures  []junitXmlResult `xml:"failure"`
+	Errors    []junitXmlResult `xml:"error"`
+	Skipped   *junitXmlResult  `xml:"skipped"`
+	SystemOut []string         `xml:"system-out"`
+	SystemErr []string         `xml:"system-err"`
+}
+
+// Both <testsuites> and <testsuite>, which may be nested
+type junitXmlSuite struct {
+	XMLName   xml.Name
+	Name      string          `xml:"name,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Suites    []junitXmlSuite `xml:"testsuite"`
+	Cases     []junitXmlCase  `xml:"testcase"`
+}
+
+// The files of an imported run, by name
+type junitImport struct {
+	files map[string][]byte
+	// Written last, so the run is complete once it has a plan
+	plan []byte
+}
+
+// Parses the params out of a test name, see above
+func parseJunitParams(params_regex *regexp.Regexp, name string) (string, map[string]interface{}) {
+	params := make(map[string]interface{})
+	match := params_regex.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name, params
+	}
+	for i, param := range params_regex.SubexpNames() {
+		if param != "" && match[2*i] >= 0 {
+			params[param] = name[match[2*i]:match[2*i+1]]
+		}
+	}
+	return name[:match[0]] + name[match[1]:], params
+}
+
+// Same as the pytest plugin, the log file is named after the test, with a
+// hash of the test id when it had to be changed
+func junitLogFileName(test_id string) string {
+	name := []byte(test_id)
+	changed := false
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '[' || c == ']') &&
+			!(c == '.' && i > 0) {
+			name[i] = '_'
+			changed = true
+		}
+	}
+	if changed || len(name) > 110 {
+		digest := sha1.Sum([]byte(test_id))
+		hash := base32.StdEncoding.EncodeToString(digest[:5])
+		if len(name) > 100 {
+			name = append(append(name[:50:50], '-'), name[len(name)-50:]...)
+		}
+		name = append(append(name, '-'), hash...)
+	}
+	return string(name) + ".log.jsonl"
+}
+
+func appendJsonLine(buf *bytes.Buffer, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	buf.WriteByte('\n')
+	return nil
+}
+
+func appendJunitLog(buf *bytes.Buffer, outputs []string, name string, level string, log_time float64) error {
+	for _, output := range outputs {
+		output = strings.TrimRight(output, "\n")
+		if strings.TrimSpace(output) == "" {
+			continue
+		}
+		for _, line := range strings.Split(output, "\n") {
+			err := appendJsonLine(buf, map[string]interface{}{
+				"name":    name,
+				"level":   level,
+				"time":    log_time,
+				"message": strings.TrimRight(line, "\r"),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Converts a JUnit XML report into the files of a run
+func importJunit(reader io.Reader, params_regex *regexp.Regexp) (*junitImport, error) {
+	var root junitXmlSuite
+	err := xml.NewDecoder(reader).Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid junit xml: %w", err)
+	}
+	if root.XMLName.Local != "testsuites" && root.XMLName.Local != "testsuite" {
+		return nil, fmt.Errorf("invalid junit xml: unexpected <%s>", root.XMLName.Local)
+	}
+
+	result := &junitImport{files: make(map[string][]byte)}
+	plan := runPlan{WorkerCount: 1, Groups: make(map[string][]runPlanTestItem), RowParams: []string{}}
+	var statuses bytes.Buffer
+	var row_params map[string]bool
+	seen := make(map[string]bool)
+	test_time := float64(time.Now().Unix())
+
+	var importSuite func(suite junitXmlSuite, group string) error
+	importSuite = func(suite junitXmlSuite, group string) error {
+		if suite.Name != "" && suite.XMLName.Local == "testsuite" {
+			group = suite.Name
+		}
+		if timestamp, err := time.Parse("2006-01-02T15:04:05", strings.TrimSuffix(suite.Timestamp, "Z")); err == nil {
+			test_time = float64(timestamp.Unix())
+		}
+
+		for _, test_case := range suite.Cases {
+			name, params := parseJunitParams(params_regex, test_case.Name)
+			test_id := test_case.Name
+			if test_case.Classname != "" {
+				test_id = test_case.Classname + "::" + test_case.Name
+			}
+			// Some frameworks report every retry of a test as its own testcase
+			for i, base_id := 2, test_id; seen[test_id]; i++ {
+				test_id = fmt.Sprintf("%s (%d)", base_id, i)
+			}
+			seen[test_id] = true
+
+			if row_params == nil {
+				row_params = make(map[string]bool)
+				for param := range params {
+					row_params[param] = true
+				}
+			} else {
+				for param := range row_params {
+					if _, ok := params[param]; !ok {
+						delete(row_params, param)
+					}
+				}
+			}
+
+			test_item := runPlanTestItem{Id: test_id, LogFile: junitLogFileName(test_id), Name: name, Params: params}
+			plan.Groups[group] = append(plan.Groups[group], test_item)
+
+			duration, err := strconv.ParseFloat(strings.ReplaceAll(test_case.Time, ",", ""), 64)
+			if err != nil || !(duration >= 0) || math.IsInf(duration, 0) {
+				duration = 0
+			}
+			call := map[string]interface{}{"type": "call", "outcome": "passed", "test": test_id, "duration": duration}
+			switch {
+			case len(test_case.Failures) > 0:
+				call["outcome"] = "failed"
+				call["exception"] = junitException(test_case.Failures[0])
+			case len(test_case.Errors) > 0:
+				call["outcome"] = "error"
+				call["exception"] = junitException(test_case.Errors[0])
+			case test_case.Skipped != nil:
+				call["outcome"] = "skipped"
+				call["reason"] = strings.TrimSpace(test_case.Skipped.Message)
+				if call["reason"] == "" {
+					call["reason"] = strings.TrimSpace(test_case.Skipped.Text)
+				}
+			}
+
+			var test_log bytes.Buffer
+			err = appendJsonLine(&statuses, map[string]interface{}{"type": "start", "test": test_id, "time": test_time})
+			if err == nil {
+				err = appendJunitLog(&test_log, test_case.SystemOut, "stdout", "INFO", test_time)
+			}
+			if err == nil {
+				err = appendJunitLog(&test_log, test_case.SystemErr, "stderr", "ERROR", test_time)
+			}
+			result.files[test_item.LogFile] = test_log.Bytes()
+
+			test_time += duration
+			call["time"] = test_time
+			if err == nil {
+				err = appendJsonLine(&statuses, call)
+			}
+			if err == nil {
+				err = appendJsonLine(&statuses, map[string]interface{}{"type": "finish", "outcome": call["outcome"], "test": test_id, "time": test_time})
+			}
+			if err != nil {
+				return fmt.Errorf("testcase '%s': %w", test_id, err)
+			}
+		}
+
+		for _, child := range suite.Suites {
+			err := importSuite(child, group)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = importSuite(root, junitImportGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(seen) == 0 {
+		return nil, errors.New("invalid junit xml: no testcases")
+	}
+	for param := range row_params {
+		plan.RowParams = append(plan.RowParams, param)
+	}
+	sort.Strings(plan.RowParams)
+	result.plan, err = json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	result.files["status.0.jsonl"] = statuses.Bytes()
+	result.files[runEndMarker] = []byte("{}")
+	return result, nil
+}
+
+// The exception of a failure as pytest would show it, the last line is its title
+func junitException(failure junitXmlResult) string {
+	title := strings.TrimSpace(failure.Message)
+	if failure.Type != "" && !strings.HasPrefix(title, failure.Type) {
+		title = strings.TrimSpace(failure.Type + ": " + title)
+	}
+	text := strings.TrimSpace(failure.Text)
+	switch {
+	case text == "":
+		return title
+	case title == "" || strings.HasSuffix(text, title):
+		return text
+	default:
+		return text + "\n" + title
+	}
+}
+
+// Writes an imported run into `projects_dir`, failing if the run already exists
+func writeJunitImport(project string, run string, imported *junitImport) error {
+	err := os.MkdirAll(filepath.Join(config.ProjectsDir, project), 0o755)
+	if err != nil {
+		return err
+	}
+	// Creating the directory is what claims the run, so two imports can't both write it
+	run_dir := filepath.Join(config.ProjectsDir, project, run)
+	err = os.Mkdir(run_dir, 0o755)
+	if errors.Is(err, fs.ErrExist) {
+		return errJunitRunExists
+	}
+	if err != nil {
+		return err
+	}
+	err = writeJunitFiles(project, run, imported)
+	if err != nil {
+		// A partial run would refuse the next attempt to import it
+		os.RemoveAll(run_dir)
+		return err
+	}
+	runPlanCache.invalidate(runPlanCacheKey{project, run})
+	forgetFinishedRun(project, run)
+	return nil
+}
+
+// The plan goes last, so readers never see it before the files it points to
+func writeJunitFiles(project string, run string, imported *junitImport) error {
+	for name, data := range imported.files {
+		err := replaceIngestFile(project, run, name, data, false)
+		if err != nil {
+			return err
+		}
+	}
+	return replaceIngestFile(project, run, "plan.json", imported.plan, false)
+}
+
+func ingestJunitHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	params_regex, err := regexp.Compile(config.Junit.ParamsRegex)
+	if err != nil {
+		log.Printf("%s %s: params_regex: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	imported, err := importJunit(r.Body, params_regex)
+	if err != nil {
+		http.Error(w, err.Error(), ingestBodyStatus(err))
+		return
+	}
+
+	err = writeJunitImport(project, run, imported)
+	if errors.Is(err, errJunitRunExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("%s %s: write run: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// The `import-junit` subcommand, `args` are the arguments after it
+func importJunitCommand(args []string) {
+	flags := flag.NewFlagSet("import-junit", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import-junit [-config config.toml] <project> <run> <junit.xml>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var configPath string
+	flags.StringVar(&configPath, "config", "config.toml", "The path to the server configuration")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	project, run, path := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	if isDirTraversal(project) || isDirTraversal(run) {
+		log.Fatalf("Invalid project or run name")
+	}
+
+	_, err := toml.DecodeFile(configPath, &config)
+	if err != nil {
+		log.Fatalln("Failed to parse config file:", err)
+	}
+	if config.Storage.Backend != "fs" {
+		log.Fatalf("Runs can only be imported into projects_dir")
+	}
+	params_regex, err := regexp.Compile(config.Junit.ParamsRegex)
+	if err != nil {
+		log.Fatalln("Invalid junit params_regex:", err)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		log.Fatalln("Failed to open the junit report:", err)
+	}
+	defer fd.Close()
+	imported, err := importJunit(fd, params_regex)
+	if err != nil {
+		log.Fatalln("Failed to import the junit report:", err)
+	}
+	err = writeJunitImport(project, run, imported)
+	if err != nil {
+		log.Fatalln("Failed to write the run:", err)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// -- Known issues --
+//
+// Each project may have a `known_issues.toml` next to its `metadata.toml`,
+// with rules mapping failures to the ticket tracking them:
+//
+//	[[rules]]
+//	id = "net-timeout"
+//	ticket = "BUG-123"
+//	label = "Flaky network in CI"
+//	exception = "ConnectionError: .* timed out"
+//	test = "^tests/test_net\\.py::"
+//	params = { arch = "^arm" }
+//
+// All of the regexes that are set must match (anywhere in the exception
+// text, test id or param value) for a failure to match a rule, and the first
+// matching rule wins.
+
+const knownIssuesFile = "known_issues.toml"
+
+type knownIssueRule struct {
+	Id        string            `toml:"id" json:"id"`
+	Ticket    string            `toml:"ticket" json:"ticket"`
+	Label     string            `toml:"label" json:"label"`
+	Exception string            `toml:"exception,omitempty" json:"exception,omitempty"`
+	Test      string            `toml:"test,omitempty" json:"test,omitempty"`
+	Params    map[string]string `toml:"params,omitempty" json:"params,omitempty"`
+}
+
+type knownIssuesFileContents struct {
+	Rules []knownIssueRule `toml:"rules" json:"rules"`
+}
+
+type knownIssueMatch struct {
+	Rule   string `json:"rule"`
+	Ticket string `json:"ticket"`
+	Label  string `json:"label"`
+	// See knownIssueTicketUrl
+	TicketUrl string `json:"ticket_url,omitempty"`
+}
+
+type compiledKnownIssueRule struct {
+	knownIssueRule
+	exception *regexp.Regexp
+	test      *regexp.Regexp
+	params    map[string]*regexp.Regexp
+}
+
+type knownIssuesCacheVal struct {
+	rules     []knownIssueRule
+	compiled  []compiledKnownIssueRule
+	expiresAt time.Time
+}
+
+var knownIssuesCache = struct {
+	sync.Mutex
+	entries map[string]knownIssuesCacheVal
+}{entries: make(map[string]knownIssuesCacheVal)}
+
+// Serializes the updates of known_issues.toml files
+var knownIssuesWriteLock sync.Mutex
+
+func compileKnownIssueRule(rule knownIssueRule) (compiledKnownIssueRule, error) {
+	compiled := compiledKnownIssueRule{knownIssueRule: rule, params: make(map[string]*regexp.Regexp)}
+	if rule.Id == "" || rule.Ticket == "" {
+		return compiled, fmt.Errorf("rule without an id or a ticket")
+	}
+	if rule.Exception == "" && rule.Test == "" && len(rule.Params) == 0 {
+		return compiled, fmt.Errorf("rule '%s' matches everything", rule.Id)
+	}
+
+	var err error
+	if rule.Exception != "" {
+		compiled.exception, err = regexp.Compile(rule.Exception)
+		if err != nil {
+			return compiled, fmt.Errorf("rule '%s': exception: %w", rule.Id, err)
+		}
+	}
+	if rule.Test != "" {
+		compiled.test, err = regexp.Compile(rule.Test)
+		if err != nil {
+			return compiled, fmt.Errorf("rule '%s': test: %w", rule.Id, err)
+		}
+	}
+	for param, pattern := range rule.Params {
+		compiled.params[param], err = regexp.Compile(pattern)
+		if err != nil {
+			return compiled, fmt.Errorf("rule '%s': param '%s': %w", rule.Id, param, err)
+		}
+	}
+	return compiled, nil
+}
+
+func (rule *compiledKnownIssueRule) matches(test string, params map[string]interface{}, exception string) bool {
+	if rule.exception != nil && !rule.exception.MatchString(exception) {
+		return false
+	}
+	if rule.test != nil && !rule.test.MatchString(test) {
+		return false
+	}
+	for param, pattern := range rule.params {
+		value, ok := params[param]
+		if !ok || !pattern.MatchString(fmt.Sprint(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func readKnownIssues(project string) ([]knownIssueRule, error) {
+	fd, err := storage.OpenProjectFile(project, knownIssuesFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []knownIssueRule{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var contents knownIssuesFileContents
+	_, err = toml.NewDecoder(fd).Decode(&contents)
+	if err != nil {
+		return nil, err
+	}
+	if contents.Rules == nil {
+		contents.Rules = []knownIssueRule{}
+	}
+	return contents.Rules, nil
+}
+
+// Returns the rules of a project, and their compiled form (without any invalid rules)
+func getKnownIssues(project string) ([]knownIssueRule, []compiledKnownIssueRule) {
+	knownIssuesCache.Lock()
+	val, ok := knownIssuesCache.entries[project]
+	knownIssuesCache.Unlock()
+	if ok && val.expiresAt.After(time.Now()) {
+		return val.rules, val.compiled
+	}
+
+	rules, err := readKnownIssues(project)
+	if err != nil {
+		log.Printf("Failed to read the known issues of '%s': %v", project, err)
+		rules = []knownIssueRule{}
+	}
+	val = knownIssuesCacheVal{
+		rules:     rules,
+		compiled:  make([]compiledKnownIssueRule, 0, len(rules)),
+		expiresAt: time.Now().Add(time.Duration(config.KnownIssues.CacheMs) * time.Millisecond),
+	}
+	for _, rule := range rules {
+		compiled, err := compileKnownIssueRule(rule)
+		if err != nil {
+			log.Printf("Ignoring known issue of '%s': %v", project, err)
+			continue
+		}
+		val.compiled = append(val.compiled, compiled)
+	}
+
+	knownIssuesCache.Lock()
+	knownIssuesCache.entries[project] = val
+	knownIssuesCache.Unlock()
+	return val.rules, val.compiled
+}
+
+func matchKnownIssue(rules []compiledKnownIssueRule, test string, params map[string]interface{}, exception string) *knownIssueMatch {
+	for i := range rules {
+		if rules[i].matches(test, params, exception) {
+			return &knownIssueMatch{Rule: rules[i].Id, Ticket: rules[i].Ticket, Label: rules[i].Label, TicketUrl: knownIssueTicketUrl(rules[i].Ticket)}
+		}
+	}
+	return nil
+}
+
+// Links to a ticket, either given as a URL or through the `ticket_url` template
+func knownIssueTicketUrl(ticket string) string {
+	if strings.HasPrefix(ticket, "https://") || strings.HasPrefix(ticket, "http://") {
+		return ticket
+	}
+	if ticket == "" || config.KnownIssues.TicketUrl == "" {
+		return ""
+	}
+	return strings.ReplaceAll(config.KnownIssues.TicketUrl, "{ticket}", url.PathEscape(ticket))
+}
+
+func isFailedStatus(status_obj map[string]interface{}) bool {
+	if status_obj["type"] == "finish" {
+		return status_obj["outcome"] != "passed" && status_obj["outcome"] != "skipped"
+	}
+	return status_obj["exception"] != nil
+}
+
+// Adds a "known_issue" to the failed statuses of a summary that match a rule.
+// The status objects are shared with the summary cache, so matches are set on copies.
+func annotateKnownIssues(project string, plan *runPlan, statuses []map[string]map[string]interface{}) {
+	_, rules := getKnownIssues(project)
+	if len(rules) == 0 {
+		return
+	}
+
+	// The statuses are shared with the summary cache, each worker's are copied before the first change
+	copied := make([]bool, len(statuses))
+	for _, group := range plan.Groups {
+		for _, test_item := range group {
+			for worker_id := range statuses {
+				status_obj, ok := statuses[worker_id][test_item.Id]
+				if !ok || !isFailedStatus(status_obj) {
+					continue
+				}
+				exception, _ := status_obj["exception"].(string)
+				match := matchKnownIssue(rules, test_item.Id, test_item.Params, exception)
+				if match != nil {
+					if !copied[worker_id] {
+						statuses[worker_id] = maps.Clone(statuses[worker_id])
+						copied[worker_id] = true
+					}
+					status_obj = maps.Clone(status_obj)
+					status_obj["known_issue"] = match
+					statuses[worker_id][test_item.Id] = status_obj
+				}
+			}
+		}
+	}
+}
+
+func writeKnownIssues(project string, rules []knownIssueRule) error {
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(knownIssuesFileContents{Rules: rules})
+	if err != nil {
+		return err
+	}
+
+	projectPath := filepath.Join(config.ProjectsDir, project)
+	tmpFd, err := os.CreateTemp(projectPath, "."+knownIssuesFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFd.Name())
+	err = fullWriteBytes(tmpFd, buf.Bytes())
+	if closeErr := tmpFd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFd.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFd.Name(), filepath.Join(projectPath, knownIssuesFile))
+	}
+
+	knownIssuesCache.Lock()
+	delete(knownIssuesCache.entries, project)
+	knownIssuesCache.Unlock()
+	return err
+}
+
+func knownIssuesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	if isDirTraversal(project) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	rules, err := readKnownIssues(project)
+	if err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(knownIssuesFileContents{Rules: rules})
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
+
+// Wraps the handlers that modify the known issues, which need a triage token
+// and only work on local storage
+func knownIssuesEditable(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.KnownIssues.Editable {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if _, ok := storage.(*fsStorage); !ok {
+			http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+			return
+		}
+		if !bearerAuthorized(r, config.KnownIssues.Tokens) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		project := r.PathValue("project")
+		if isDirTraversal(project) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if info, err := os.Stat(filepath.Join(config.ProjectsDir, project)); err != nil || !info.IsDir() {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+		handler(w, r)
+	}
+}
+
+// Adds a rule, or replaces the rule with the same id
+func knownIssuePutHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+
+	var rule knownIssueRule
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	rule.Id = r.PathValue("rule")
+	_, err = compileKnownIssueRule(rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	knownIssuesWriteLock.Lock()
+	defer knownIssuesWriteLock.Unlock()
+
+	rules, err := readKnownIssues(project)
+	if err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	replaced := false
+	for i := range rules {
+		if rules[i].Id == rule.Id {
+			rules[i] = rule
+			replaced = true
+		}
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	err = writeKnownIssues(project, rules)
+	if err != nil {
+		log.Printf("%s %s: write known issues: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func knownIssueDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	id := r.PathValue("rule")
+
+	knownIssuesWriteLock.Lock()
+	defer knownIssuesWriteLock.Unlock()
+
+	rules, err := readKnownIssues(project)
+	if err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	kept := make([]knownIssueRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Id != id {
+			kept = append(kept, rule)
+		}
+	}
+	if len(kept) == len(rules) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	err = writeKnownIssues(project, kept)
+	if err != nil {
+		log.Printf("%s %s: write known issues: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
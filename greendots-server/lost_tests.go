@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -- Crashed and hung tests --
+//
+// When an xdist worker dies, its status file just stops after the `start` of
+// the test it was running. A test that started and didn't finish is reported
+// as crashed once another test started on the same worker (xdist replaces
+// dead workers), and as hung once its worker wrote nothing for
+// `hung_timeout_ms`. Either way it gets a made up "finish" status, with the
+// last lines of its log, in the status summary and the events stream, and an
+// "error" result everywhere else (listings, history, notifications, ...). A
+// real "finish" showing up later replaces it as usual.
+
+const (
+	testOutcomeCrashed = "crashed"
+	testOutcomeHung    = "hung"
+)
+
+const logTailCacheMaxEntries = 256
+
+// The log tails of lost tests, by the size of the log they were read from
+type logTailKey struct {
+	project   string
+	run       string
+	test      string
+	size      int64
+	lineCount int
+}
+
+var logTailCache = struct {
+	sync.Mutex
+	entries map[logTailKey][]string
+}{entries: make(map[logTailKey][]string)}
+
+// Returns the last lines of the log of a test, formatted as plain text. They
+// must not be modified, they're cached until the log grows.
+func readLogTail(project string, run string, test string, line_count int) []string {
+	lines := []string{}
+	logFile, err := getTestLogFile(project, run, test)
+	if err != nil {
+		return lines
+	}
+	log_fd, err := openLogFile(project, run, logFile)
+	if err != nil {
+		return lines
+	}
+	defer log_fd.Close()
+
+	size, err := log_fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return lines
+	}
+	key := logTailKey{project, run, test, size, line_count}
+	logTailCache.Lock()
+	cached, ok := logTailCache.entries[key]
+	logTailCache.Unlock()
+	if ok {
+		return cached
+	}
+
+	// Same as logTailHandler, the last 128KB are probably enough
+	start_offset, err := log_fd.Seek(max(size-128*1024, 0), io.SeekStart)
+	if err != nil {
+		return lines
+	}
+
+	scanner := bufio.NewScanner(log_fd)
+	if start_offset != 0 {
+		// Skip the first line, it's probably cut in the middle
+		scanner.Scan()
+	}
+	for scanner.Scan() {
+		json_line := scanner.Bytes()
+		if len(json_line) == 0 {
+			continue
+		}
+		log_line, valid := parseJsonLogLine(json_line)
+		line := log_line.Message
+		if valid {
+			line = fmt.Sprintf("%s %s: %s", log_line.Level, log_line.Name, log_line.Message)
+		}
+		lines_start := min(len(lines), max(0, len(lines)-line_count+1))
+		lines = append(lines[lines_start:], line)
+	}
+
+	logTailCache.Lock()
+	defer logTailCache.Unlock()
+	if len(logTailCache.entries) >= logTailCacheMaxEntries {
+		for evicted := range logTailCache.entries {
+			delete(logTailCache.entries, evicted)
+			break
+		}
+	}
+	logTailCache.entries[key] = lines
+	return lines
+}
+
+// The reason a test will never finish, as the title of its made up exception
+func lostTestMessage(worker_id int, outcome string) string {
+	if outcome == testOutcomeCrashed {
+		return fmt.Sprintf("Crashed: worker %d started another test before this one finished", worker_id)
+	}
+	return fmt.Sprintf("Hung: worker %d wrote nothing for over %s", worker_id, time.Duration(config.Lifecycle.HungTimeoutMs)*time.Millisecond)
+}
+
+// Returns the status reporting a test that will never finish, based on its last status
+func lostTestStatus(project string, run string, worker_id int, test string, outcome string, status_obj map[string]interface{}) map[string]interface{} {
+	message := lostTestMessage(worker_id, outcome)
+
+	log_tail := readLogTail(project, run, test, config.LogTail.DefaultLineCount)
+	exception := message
+	if len(log_tail) > 0 {
+		// The message goes last, the last line of an exception is its title
+		exception = "Last log lines:\n  " + strings.Join(log_tail, "\n  ") + "\n\n" + message
+	}
+
+	status_obj = maps.Clone(status_obj)
+	if status_obj == nil {
+		status_obj = make(map[string]interface{})
+	}
+	status_obj["type"] = "finish"
+	status_obj["test"] = test
+	status_obj["outcome"] = outcome
+	status_obj["exception"] = exception
+	status_obj["log_tail"] = log_tail
+	return status_obj
+}
+
+// Returns the tests of a worker that started and will probably never finish, with their outcome
+func findLostTests(snapshot statusSnapshot) map[string]string {
+	lost := make(map[string]string)
+	for i, test := range snapshot.Timeline {
+		if test.End != 0 || snapshot.Statuses[test.Test]["type"] == "finish" {
+			continue
+		}
+		if i < len(snapshot.Timeline)-1 {
+			lost[test.Test] = testOutcomeCrashed
+		} else if time.Since(snapshot.ModTime) > time.Duration(config.Lifecycle.HungTimeoutMs)*time.Millisecond {
+			lost[test.Test] = testOutcomeHung
+		}
+	}
+	return lost
+}
+
+// Replaces the statuses of lost tests in a summary, see findLostTests
+func annotateLostTests(project string, run string, snapshots []statusSnapshot, statuses []map[string]map[string]interface{}) {
+	for worker_id, snapshot := range snapshots {
+		lost := findLostTests(snapshot)
+		if len(lost) == 0 {
+			continue
+		}
+		// Shared with the summary cache, see annotateKnownIssues
+		statuses[worker_id] = maps.Clone(statuses[worker_id])
+		for test, outcome := range lost {
+			statuses[worker_id][test] = lostTestStatus(project, run, worker_id, test, outcome, statuses[worker_id][test])
+		}
+	}
+}
+
+// Follows the status lines of a worker in the events stream, to report its
+// lost tests as they are found
+type lostTestsWatch struct {
+	workerId int
+	// Lines up to this offset were already seen by the summary
+	offset int64
+	// The test that started last and didn't finish yet, and its last status
+	running       string
+	runningStatus map[string]interface{}
+	lastWrite     time.Time
+	reportedHung  bool
+}
+
+func newLostTestsWatch(worker_id int, snapshot statusSnapshot) *lostTestsWatch {
+	watch := &lostTestsWatch{workerId: worker_id, offset: snapshot.Offset, lastWrite: snapshot.ModTime}
+	if len(snapshot.Timeline) > 0 {
+		last := snapshot.Timeline[len(snapshot.Timeline)-1]
+		if last.End == 0 && snapshot.Statuses[last.Test]["type"] != "finish" {
+			watch.running = last.Test
+			watch.runningStatus = snapshot.Statuses[last.Test]
+		}
+	}
+	return watch
+}
+
+// Returns the status of a test that crashed because of this line, if any
+func (watch *lostTestsWatch) line(project string, run string, line tailLine) map[string]interface{} {
+	if line.EndOffset <= watch.offset {
+		return nil
+	}
+	watch.lastWrite = time.Now()
+
+	var status_obj map[string]interface{}
+	if json.Unmarshal(line.Data, &status_obj) != nil {
+		return nil
+	}
+	test, ok := status_obj["test"].(string)
+	if !ok {
+		return nil
+	}
+
+	var crashed map[string]interface{}
+	switch status_obj["type"] {
+	case "start":
+		if watch.running != "" && watch.running != test {
+			crashed = lostTestStatus(project, run, watch.workerId, watch.running, testOutcomeCrashed, watch.runningStatus)
+		}
+		watch.running = test
+		watch.reportedHung = false
+	case "finish":
+		if watch.running == test {
+			watch.running = ""
+		}
+	}
+	if watch.running == test {
+		watch.runningStatus = status_obj
+	}
+	return crashed
+}
+
+// Returns the status of the running test once it's hung, only once
+func (watch *lostTestsWatch) check(project string, run string) map[string]interface{} {
+	if watch.running == "" || watch.reportedHung {
+		return nil
+	}
+	if time.Since(watch.lastWrite) <= time.Duration(config.Lifecycle.HungTimeoutMs)*time.Millisecond {
+		return nil
+	}
+	watch.reportedHung = true
+	return lostTestStatus(project, run, watch.workerId, watch.running, testOutcomeHung, watch.runningStatus)
+}
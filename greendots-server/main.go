@@ -6,6 +6,7 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,10 +15,10 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"path/filepath"
 	"regexp"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -60,6 +61,13 @@ type run struct {
 	PrettyAge string                 `json:"pretty_age"`
 	CreatedAt string                 `json:"created_at"`
 	Metadata  map[string]interface{} `json:"metadata"`
+	// See run_state.go
+	State        string            `json:"state"`
+	LastActivity string            `json:"last_activity"`
+	Counts       *runOutcomeCounts `json:"counts"`
+	Duration     float64           `json:"duration"`
+	// Only for running runs, see eta.go
+	Eta *runEta `json:"eta"`
 }
 type runPlan struct {
 	WorkerCount int                          `json:"worker_count"`
@@ -112,8 +120,124 @@ type clientTestStatusConfig struct {
 	BackoffJitterMs int `toml:"backoff_jitter_ms" json:"backoff_jitter_ms"`
 }
 
+type watcherConfig struct {
+	Mode         string `toml:"mode" json:"mode"`
+	SafetyPollMs int    `toml:"safety_poll_ms" json:"safety_poll_ms"`
+}
+
+type tailerConfig struct {
+	RingLines int `toml:"ring_lines" json:"ring_lines"`
+	RingBytes int `toml:"ring_bytes" json:"ring_bytes"`
+}
+
+type lifecycleConfig struct {
+	StallTimeoutMs   int `toml:"stall_timeout_ms" json:"stall_timeout_ms"`
+	AbandonTimeoutMs int `toml:"abandon_timeout_ms" json:"abandon_timeout_ms"`
+	// A running test is reported as hung once its worker wrote nothing for this long
+	HungTimeoutMs int `toml:"hung_timeout_ms" json:"hung_timeout_ms"`
+}
+
+type historyConfig struct {
+	DefaultRuns int `toml:"default_runs" json:"default_runs"`
+	MaxRuns     int `toml:"max_runs" json:"max_runs"`
+}
+
+type flakyConfig struct {
+	CommitKey string `toml:"commit_key" json:"commit_key"`
+}
+
+type durationsConfig struct {
+	SlowestCount int `toml:"slowest_count" json:"slowest_count"`
+	// The number of previous runs whose median duration a test is compared with
+	BaselineRuns     int     `toml:"baseline_runs" json:"baseline_runs"`
+	RegressionFactor float64 `toml:"regression_factor" json:"regression_factor"`
+	// Tests that took less than this in the run are never flagged, however fast they were in the baseline
+	MinDuration float64 `toml:"min_duration" json:"min_duration"`
+}
+
+type timelineConfig struct {
+	MinGapMs int `toml:"min_gap_ms" json:"min_gap_ms"`
+}
+
+type junitConfig struct {
+	// Only the end of longer logs is exported, 0 for no limit
+	MaxLogBytes int64 `toml:"max_log_bytes" json:"max_log_bytes"`
+	// The named groups become the params of imported tests, see junit_import.go
+	ParamsRegex string `toml:"params_regex" json:"params_regex"`
+}
+
+type knownIssuesConfig struct {
+	// Allows adding, updating and removing rules through the API, with one of `tokens`
+	Editable bool     `toml:"editable" json:"editable"`
+	Tokens   []string `toml:"tokens" json:"-"`
+	// How long the rules of a project are cached before reading them again
+	CacheMs int `toml:"cache_ms" json:"cache_ms"`
+	// Links tickets that aren't URLs themselves, "{ticket}" is replaced with the ticket
+	TicketUrl string `toml:"ticket_url" json:"ticket_url"`
+}
+
+type webhookConfig struct {
+	Url string `toml:"url" json:"url"`
+	// Empty for all projects
+	Projects []string `toml:"projects" json:"projects"`
+	// Empty for all events, see notifications.go
+	Events []string `toml:"events" json:"events"`
+}
+
+type smtpConfig struct {
+	Host string `toml:"host" json:"host"`
+	Port int    `toml:"port" json:"port"`
+	// No authentication if empty
+	Username string `toml:"username" json:"-"`
+	Password string `toml:"password" json:"-"`
+	From     string `toml:"from" json:"from"`
+}
+
+type digestConfig struct {
+	// Empty to disable the digests, see digests.go
+	SendAt string `toml:"send_at" json:"send_at"`
+	// How many days the pass rate trend covers
+	TrendDays int `toml:"trend_days" json:"trend_days"`
+	// At most this many new failures and flaky tests are listed for each project
+	MaxTests int `toml:"max_tests" json:"max_tests"`
+}
+
+type notificationsConfig struct {
+	// The address of the server as seen by the receivers, for the links in notifications
+	BaseUrl        string `toml:"base_url" json:"base_url"`
+	ScanIntervalMs int    `toml:"scan_interval_ms" json:"scan_interval_ms"`
+	// How many of the most recent runs of each project are checked for events
+	ScanRuns       int             `toml:"scan_runs" json:"scan_runs"`
+	MaxAttempts    int             `toml:"max_attempts" json:"max_attempts"`
+	RetryBackoffMs int             `toml:"retry_backoff_ms" json:"retry_backoff_ms"`
+	TimeoutMs      int             `toml:"timeout_ms" json:"timeout_ms"`
+	Webhooks       []webhookConfig `toml:"webhooks" json:"-"`
+	Smtp           smtpConfig      `toml:"smtp" json:"smtp"`
+	Digest         digestConfig    `toml:"digest" json:"digest"`
+}
+
+type eventsConfig struct {
+	KeepaliveMs int `toml:"keepalive_ms" json:"keepalive_ms"`
+}
+
 type cachingConfig struct {
-	PlanCacheMs int `toml:"plan_cache_ms" json:"plan_cache_ms"`
+	PlanCacheMs       int   `toml:"plan_cache_ms" json:"plan_cache_ms"`
+	PlanCacheMaxBytes int64 `toml:"plan_cache_max_bytes" json:"plan_cache_max_bytes"`
+	SummaryIdleMs     int   `toml:"summary_idle_ms" json:"summary_idle_ms"`
+	// How long the summaries of unfinished runs are reused by the listings
+	ListingCacheMs int `toml:"listing_cache_ms" json:"listing_cache_ms"`
+	// How long the expected test durations of a running run are reused by its ETA
+	EtaBaselineCacheMs int `toml:"eta_baseline_cache_ms" json:"eta_baseline_cache_ms"`
+}
+
+type ingestConfig struct {
+	Tokens       []string `toml:"tokens" json:"-"`
+	MaxBodyBytes int64    `toml:"max_body_bytes" json:"max_body_bytes"`
+}
+
+type storageConfig struct {
+	Backend string          `toml:"backend" json:"backend"`
+	S3      s3StorageConfig `toml:"s3" json:"s3"`
 }
 
 type clientConfig struct {
@@ -124,10 +248,24 @@ type greendotsConfig struct {
 	StatusPoll          statusPollConfig    `toml:"status_poll" json:"status_poll"`
 	StatusStream        statusStreamConfig  `toml:"status_stream" json:"status_stream"`
 	LogTail             logTailConfig       `toml:"log_tail" json:"log_tail"`
+	Events              eventsConfig        `toml:"events" json:"events"`
+	Watcher             watcherConfig       `toml:"watcher" json:"watcher"`
+	Tailer              tailerConfig        `toml:"tailer" json:"tailer"`
 	Caching             cachingConfig       `toml:"caching" json:"caching"`
+	Lifecycle           lifecycleConfig     `toml:"lifecycle" json:"lifecycle"`
+	History             historyConfig       `toml:"history" json:"history"`
+	Flaky               flakyConfig         `toml:"flaky" json:"flaky"`
+	Durations           durationsConfig     `toml:"durations" json:"durations"`
+	Timeline            timelineConfig      `toml:"timeline" json:"timeline"`
+	KnownIssues         knownIssuesConfig   `toml:"known_issues" json:"known_issues"`
+	Notifications       notificationsConfig `toml:"notifications" json:"notifications"`
+	Junit               junitConfig         `toml:"junit" json:"junit"`
 	Client              clientConfig        `toml:"client" json:"client"`
+	Ingest              ingestConfig        `toml:"ingest" json:"ingest"`
+	Storage             storageConfig       `toml:"storage" json:"storage"`
 	AdditionalLogLevels map[string]logLevel `toml:"additional_log_levels" json:"additional_log_levels"`
 	ProjectsDir         string              `toml:"projects_dir" json:"projects_dir"`
+	StateDir            string              `toml:"state_dir" json:"state_dir"`
 	ListenAddress       string              `toml:"listen_address" json:"listen_address"`
 }
 
@@ -145,8 +283,65 @@ var config = greendotsConfig{
 	LogTail: logTailConfig{
 		DefaultLineCount: 25,
 	},
+	Events: eventsConfig{
+		KeepaliveMs: 15000,
+	},
+	Watcher: watcherConfig{
+		Mode:         "auto",
+		SafetyPollMs: 10000,
+	},
+	Tailer: tailerConfig{
+		RingLines: 2000,
+		RingBytes: 1024 * 1024,
+	},
 	Caching: cachingConfig{
-		PlanCacheMs: 60000,
+		PlanCacheMs:        60000,
+		PlanCacheMaxBytes:  256 * 1024 * 1024,
+		SummaryIdleMs:      10 * 60 * 1000,
+		ListingCacheMs:     5000,
+		EtaBaselineCacheMs: 60000,
+	},
+	Lifecycle: lifecycleConfig{
+		StallTimeoutMs:   10 * 60 * 1000,
+		AbandonTimeoutMs: 24 * 60 * 60 * 1000,
+		HungTimeoutMs:    5 * 60 * 1000,
+	},
+	History: historyConfig{
+		DefaultRuns: 50,
+		MaxRuns:     500,
+	},
+	Flaky: flakyConfig{
+		CommitKey: "commit",
+	},
+	Durations: durationsConfig{
+		SlowestCount:     20,
+		BaselineRuns:     10,
+		RegressionFactor: 2.0,
+		MinDuration:      1.0,
+	},
+	Timeline: timelineConfig{
+		MinGapMs: 1000,
+	},
+	KnownIssues: knownIssuesConfig{
+		CacheMs: 60000,
+	},
+	Junit: junitConfig{
+		MaxLogBytes: 1024 * 1024,
+		ParamsRegex: `\[(?P<param>[^\]]*)\]$`,
+	},
+	Notifications: notificationsConfig{
+		ScanIntervalMs: 30000,
+		ScanRuns:       20,
+		MaxAttempts:    6,
+		RetryBackoffMs: 1000,
+		TimeoutMs:      10000,
+		Smtp: smtpConfig{
+			Port: 25,
+		},
+		Digest: digestConfig{
+			TrendDays: 7,
+			MaxTests:  20,
+		},
 	},
 	Client: clientConfig{
 		TestStatus: clientTestStatusConfig{
@@ -155,35 +350,36 @@ var config = greendotsConfig{
 			BackoffJitterMs: 1000,
 		},
 	},
+	Ingest: ingestConfig{
+		MaxBodyBytes: 16 * 1024 * 1024,
+	},
+	Storage: storageConfig{
+		Backend: "fs",
+		S3: s3StorageConfig{
+			Region:    "us-east-1",
+			PathStyle: true,
+			TimeoutMs: 30000,
+		},
+	},
 	ProjectsDir:   "",
+	StateDir:      "",
 	ListenAddress: ":8080",
 }
 
 // -- Helpers --
 
 func getProjectRuns(project string) ([]run, error) {
-	projectPath := filepath.Join(config.ProjectsDir, project)
-
-	entries, err := os.ReadDir(projectPath)
+	entries, err := storage.ListRuns(project)
 	if err != nil {
 		return nil, err
 	}
 
 	runs := make([]run, 0, len(entries))
 	for _, e := range entries {
-		if !e.IsDir() {
-			continue
-		}
-
-		info, err := os.Stat(filepath.Join(projectPath, e.Name()))
-		if err != nil {
-			continue
-		}
-
 		runs = append(runs, run{
-			Id:        e.Name(),
-			CreatedAt: info.ModTime().Format(time.RFC3339),
-			PrettyAge: prettytime.Format(info.ModTime()),
+			Id:        e.Id,
+			CreatedAt: e.ModTime.Format(time.RFC3339),
+			PrettyAge: prettytime.Format(e.ModTime),
 		})
 	}
 
@@ -195,10 +391,14 @@ func getProjectRuns(project string) ([]run, error) {
 }
 
 func getProjectMetadata(project string) (map[string]interface{}, error) {
-	metadataPath := filepath.Join(config.ProjectsDir, project, "metadata.toml")
+	metadataFd, err := storage.OpenProjectFile(project, "metadata.toml")
+	if err != nil {
+		return nil, err
+	}
+	defer metadataFd.Close()
 
 	var metadata map[string]interface{}
-	_, err := toml.DecodeFile(metadataPath, &metadata)
+	_, err = toml.NewDecoder(metadataFd).Decode(&metadata)
 	if err != nil {
 		return nil, err
 	}
@@ -207,10 +407,14 @@ func getProjectMetadata(project string) (map[string]interface{}, error) {
 }
 
 func getRunMetadata(project, run string) (map[string]interface{}, error) {
-	metadataPath := filepath.Join(config.ProjectsDir, project, run, "metadata.toml")
+	metadataFd, err := storage.OpenRunFile(project, run, "metadata.toml")
+	if err != nil {
+		return nil, err
+	}
+	defer metadataFd.Close()
 
 	var metadata map[string]interface{}
-	_, err := toml.DecodeFile(metadataPath, &metadata)
+	_, err = toml.NewDecoder(metadataFd).Decode(&metadata)
 	if err != nil {
 		return nil, err
 	}
@@ -237,48 +441,8 @@ func isDirTraversal(path string) bool {
 	return path[:1] == "." || strings.Contains(path, "/")
 }
 
-type runPlanCacheKey struct {
-	project string
-	run     string
-}
-type runPlanCacheVal struct {
-	plan      runPlan
-	expiresAt time.Time
-}
-
-var runPlanCache = make(map[runPlanCacheKey]runPlanCacheVal)
-
 func getRunPlan(project string, run string) (*runPlan, error) {
-	// Try the cache first
-	key := runPlanCacheKey{project, run}
-	for key, val := range runPlanCache {
-		if val.expiresAt.Before(time.Now()) {
-			delete(runPlanCache, key)
-		}
-	}
-	if val, ok := runPlanCache[key]; ok {
-		return &val.plan, nil
-	}
-
-	// Read the plan file and cache it
-	planPath := filepath.Join(config.ProjectsDir, project, run, "plan.json")
-	planFd, err := os.Open(planPath)
-	if err != nil {
-		return nil, err
-	}
-	defer planFd.Close()
-
-	val := runPlanCacheVal{
-		expiresAt: time.Now().Add(time.Duration(config.Caching.PlanCacheMs) * time.Millisecond),
-	}
-	err = json.NewDecoder(planFd).Decode(&val.plan)
-	if err != nil {
-		log.Printf("Failed to decode plan file '%s': %v", planPath, err)
-		return nil, err
-	}
-	runPlanCache[key] = val
-
-	return &val.plan, nil
+	return runPlanCache.get(runPlanCacheKey{project, run})
 }
 
 func getTestLogFile(project string, run string, test string) (string, error) {
@@ -328,38 +492,28 @@ func versionHandler(w http.ResponseWriter, r *http.Request) {
 func projectsListHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	projectsDir, err := os.ReadDir(config.ProjectsDir)
+	projectIds, err := storage.ListProjects()
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
 	}
 
-	projects := make([]project, 0, len(projectsDir))
-	for _, projectEntry := range projectsDir {
-		if !projectEntry.IsDir() {
-			continue
-		}
-
-		runs, err := getProjectRuns(projectEntry.Name())
+	projects := make([]project, 0, len(projectIds))
+	for _, projectId := range projectIds {
+		runs, err := getProjectRuns(projectId)
 		if err != nil {
 			continue
 		}
 		runs = runs[:min(10, len(runs))]
+		fillRunDetails(projectId, runs)
 
-		for _, run := range runs {
-			metadata, err := getRunMetadata(projectEntry.Name(), run.Id)
-			if err != nil {
-				metadata = nil
-			}
-			run.Metadata = metadata
-		}
-
-		metadata, err := getProjectMetadata(projectEntry.Name())
+		metadata, err := getProjectMetadata(projectId)
 		if err != nil {
 			metadata = nil
 		}
 
 		projects = append(projects, project{
-			Id:       projectEntry.Name(),
+			Id:       projectId,
 			Runs:     runs,
 			Metadata: metadata,
 		})
@@ -385,15 +539,9 @@ func projectRunsHandler(w http.ResponseWriter, r *http.Request) {
 	runs, err := getProjectRuns(project)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
 	}
-
-	for _, run := range runs {
-		metadata, err := getRunMetadata(project, run.Id)
-		if err != nil {
-			metadata = nil
-		}
-		run.Metadata = metadata
-	}
+	fillRunDetails(project, runs)
 
 	result := runsList{Runs: runs}
 	err = json.NewEncoder(w).Encode(result)
@@ -412,33 +560,38 @@ func runPlanHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	planPath := filepath.Join(config.ProjectsDir, project, run, "plan.json")
-	http.ServeFile(w, r, planPath)
+	planFd, err := openRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer planFd.Close()
+	serveStorageFile(w, r, "plan.json", planFd)
 }
 
 type statusResult struct {
-	Statuses map[string]map[string]interface{}
-	Index    int
-	Offset   int
+	statusSnapshot
+	Index int
 }
 
-func runStatusSummaryHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/jsonl")
+// Reads the last status of each test from every status file, along with the
+// byte offset of the end of each status file (not including partial objects)
+func getStatusSummary(project string, run string, plan *runPlan) ([]map[string]map[string]interface{}, []int) {
+	snapshots := getStatusSnapshots(project, run, plan)
 
-	// Read plan file to get worker count
-	project := r.PathValue("project")
-	run := r.PathValue("run")
-	if isDirTraversal(project) || isDirTraversal(run) {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
-	}
-
-	plan, err := getRunPlan(project, run)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-		return
+	indexes := make([]int, plan.WorkerCount)
+	statuses := make([]map[string]map[string]interface{}, plan.WorkerCount)
+	for i, snapshot := range snapshots {
+		statuses[i] = snapshot.Statuses
+		indexes[i] = int(snapshot.Offset)
 	}
+	annotateLostTests(project, run, snapshots, statuses)
+	annotateKnownIssues(project, plan, statuses)
+	return statuses, indexes
+}
 
+// Same as getStatusSummary, with everything else known about each status file
+func getStatusSnapshots(project string, run string, plan *runPlan) []statusSnapshot {
 	statuses_channel := make(chan *statusResult)
 	var statuses_wg sync.WaitGroup
 	for status_idx := range plan.WorkerCount {
@@ -446,54 +599,10 @@ func runStatusSummaryHandler(w http.ResponseWriter, r *http.Request) {
 		go func(idx int) {
 			defer statuses_wg.Done()
 
-			local_result := &statusResult{
-				Statuses: make(map[string]map[string]interface{}),
-				Index:    idx,
-			}
-
-			// open the status file, if not found just ignore it
-			statusSummaryPath := filepath.Join(
-				config.ProjectsDir, project, run,
-				fmt.Sprintf("status.%d.jsonl", idx),
-			)
-			fd, err := os.Open(statusSummaryPath)
-			if err != nil {
-				return
-			}
-			defer fd.Close()
-
-			scanner := bufio.NewScanner(fd)
-			final_offset := 0
-			for scanner.Scan() {
-				line := scanner.Bytes()
-				if len(line) == 0 {
-					break
-				}
-
-				var status_obj map[string]interface{}
-				err := json.Unmarshal(line, &status_obj)
-				if err != nil {
-					// Probably a partial line, stop here
-					break
-				}
-
-				// Store the final status of each test
-				key := status_obj["test"].(string)
-				if prev_status, ok := local_result.Statuses[key]; ok {
-					prev_exc := prev_status["exception"]
-					if prev_exc != nil && status_obj["exception"] == nil {
-						status_obj["exception"] = prev_exc
-					}
-				}
-				local_result.Statuses[key] = status_obj
-
-				// Keep a counter for the offset
-				final_offset += len(line) + 1
+			statuses_channel <- &statusResult{
+				statusSnapshot: statusSummaryCache.get(project, run, idx),
+				Index:          idx,
 			}
-
-			// Set the offset and send it to be written
-			local_result.Offset = final_offset
-			statuses_channel <- local_result
 		}(status_idx)
 	}
 
@@ -503,17 +612,34 @@ func runStatusSummaryHandler(w http.ResponseWriter, r *http.Request) {
 		close(statuses_channel)
 	}()
 
-	// Get all the offsets and statuses in the correct order
-	// NOTE: while it doesn't matter for the statuses it does make it easier
-	//		 for the indexes, and we need to save them aside anyways since the header
-	//		 must be modified before writing to the body
-	indexes := make([]int, plan.WorkerCount)
-	statuses := make([]map[string]map[string]interface{}, plan.WorkerCount)
+	// Get all the snapshots in the correct order
+	snapshots := make([]statusSnapshot, plan.WorkerCount)
 	for res := range statuses_channel {
-		statuses[res.Index] = res.Statuses
-		indexes[res.Index] = res.Offset
+		snapshots[res.Index] = res.statusSnapshot
 	}
 
+	return snapshots
+}
+
+func runStatusSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jsonl")
+
+	// Read plan file to get worker count
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	statuses, indexes := getStatusSummary(project, run, plan)
+
 	// and now we can write all of the
 	for _, offset := range indexes {
 		w.Header().Add("X-End-Offset", fmt.Sprintf("%d", offset))
@@ -531,7 +657,8 @@ func runStatusSummaryHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func runStatusPollHandler(w http.ResponseWriter, r *http.Request) {
-	new_ctx, _ := context.WithTimeout(r.Context(), time.Duration(config.StatusPoll.TimeoutMs)*time.Millisecond)
+	new_ctx, cancel := context.WithTimeout(r.Context(), time.Duration(config.StatusPoll.TimeoutMs)*time.Millisecond)
+	defer cancel()
 	done := new_ctx.Done()
 	closed := w.(http.CloseNotifier).CloseNotify()
 
@@ -554,31 +681,49 @@ func runStatusPollHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Each status file is watched, so there can't be more of them than workers
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if len(expected_sizes) > plan.WorkerCount {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	// Subscribe to all of the status files, see watcher.go
+	watches := make([]*fileWatch, len(expected_sizes))
+	for i := range expected_sizes {
+		watch, release := watcher.watch(project, run, statusFileName(i), time.Duration(config.StatusPoll.SleepMs)*time.Millisecond)
+		defer release()
+		watches[i] = watch
+	}
+
 	for {
+		changed := make([]<-chan struct{}, len(watches))
+		for i, watch := range watches {
+			changed[i] = watch.Changed()
+		}
+
 		workers_to_check := []int{}
 		for i, expected_size := range expected_sizes {
-			statusPath := filepath.Join(config.ProjectsDir, project, run, fmt.Sprintf("status.%d.jsonl", i))
-			stat, err := os.Stat(statusPath)
+			stat, err := statStatusFile(project, run, i)
 			if err != nil {
 				// If the file doesn't exist, skip it and move on to the next file.
-				if os.IsNotExist(err) {
-					continue;
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
 				}
 				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 				return
 			}
-			if stat.Size() > int64(expected_size) {
+			if stat.Size > int64(expected_size) {
 				workers_to_check = append(workers_to_check, i)
 			}
 		}
 		if len(workers_to_check) == 0 {
-			select {
-			case <-done:
+			if !waitForChanges(changed, done, closed) {
 				return
-			case <-closed:
-				return
-			case <-time.After(time.Duration(config.StatusPoll.SleepMs) * time.Millisecond):
-				continue
 			}
 		} else {
 			err := json.NewEncoder(w).Encode(statusPollResponse{WorkersToCheck: workers_to_check})
@@ -596,28 +741,45 @@ func runStatusStreamHandler(w http.ResponseWriter, r *http.Request) {
 
 	project := r.PathValue("project")
 	run := r.PathValue("run")
-	worker_id := r.PathValue("worker_id")
-	if isDirTraversal(project) || isDirTraversal(run) || isDirTraversal(worker_id) {
+	worker_id, err := strconv.Atoi(r.PathValue("worker_id"))
+	if isDirTraversal(project) || isDirTraversal(run) || err != nil || worker_id < 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	statusFd, err := openStatusFile(project, run, worker_id)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	statusStreamPath := filepath.Join(config.ProjectsDir, project, run, fmt.Sprintf("status.%s.jsonl", worker_id))
-	http.ServeFile(w, r, statusStreamPath)
+	defer statusFd.Close()
+	serveStorageFile(w, r, statusFileName(worker_id), statusFd)
 }
 
 var LOGGER_NAME_BAD_CHARS = regexp.MustCompile("[^a-zA-Z0-9-_]")
 
-func formatJsonLogLine(json_line []byte, last_date *string, last_time *float64) string {
-	html_lines := ""
+// Parses a log line, lines that aren't valid JSON are shown as-is (at the time of the previous line)
+func parseJsonLogLine(json_line []byte) (logLine, bool) {
 	var log_line logLine
 	err := json.Unmarshal(json_line, &log_line)
 	if err != nil {
-		log_line = logLine{
+		return logLine{
 			Level:   "INFO",
 			Message: string(json_line),
 			Name:    "unknown",
-			Time:    *last_time,
-		}
+		}, false
+	}
+	return log_line, true
+}
+
+func formatJsonLogLine(json_line []byte, last_date *string, last_time *float64) string {
+	log_line, valid := parseJsonLogLine(json_line)
+	return formatLogLine(log_line, valid, last_date, last_time)
+}
+
+func formatLogLine(log_line logLine, valid bool, last_date *string, last_time *float64) string {
+	html_lines := ""
+	if !valid {
+		log_line.Time = *last_time
 	}
 	*last_time = log_line.Time
 
@@ -674,6 +836,11 @@ func formatJsonLogLine(json_line []byte, last_date *string, last_time *float64)
 var LT = []byte("<")
 var LT_ESC = []byte("&lt;")
 
+// Parses log lines for the shared tailers, escaped so they can be embedded in html
+func parseTailLogLine(json_line []byte) (interface{}, bool) {
+	return parseJsonLogLine(bytes.ReplaceAll(json_line, LT, LT_ESC))
+}
+
 func logStreamHandler(w http.ResponseWriter, r *http.Request) {
 	done := r.Context().Done()
 	closed := w.(http.CloseNotifier).CloseNotify()
@@ -696,13 +863,11 @@ func logStreamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log_path := filepath.Join(config.ProjectsDir, project, run, logFile)
-	log_fd, err := os.Open(log_path)
+	_, err = statRunFileMaybeCompressed(project, run, logFile)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	defer log_fd.Close()
 
 	// Send wrapper HTML
 	err = fullWriteBytes(w, logsViewPrefix)
@@ -715,62 +880,39 @@ func logStreamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Read the log file, and keep trying on EOF
-	wg := sync.WaitGroup{}
-	defer wg.Wait()
-	wg.Add(1)
-	chunk_pipe_rd, chunk_pipe_wr := io.Pipe()
-	defer chunk_pipe_rd.Close()
-	go func() {
-		defer chunk_pipe_wr.Close()
-		defer wg.Done()
-		chunk := make([]byte, config.StatusStream.ChunkSize)
-		for {
-			n, err := log_fd.Read(chunk)
-			if err != nil && err != io.EOF {
-				break
-			}
-			if n == 0 || err == io.EOF {
-				// Reached EOF, wait a bit before trying again
-				select {
-				case <-done:
-					return
-				case <-closed:
-					return
-				case <-time.After(time.Duration(config.StatusStream.EofSleepMs) * time.Millisecond):
-				}
-				continue
-			}
-			err = fullWriteBytes(chunk_pipe_wr, bytes.ReplaceAll(chunk[:n], LT, LT_ESC))
-			if err != nil {
-				break
-			}
-		}
-	}()
+	// Follow the shared tailer of the log file, see tailer.go
+	tailer, release := tailers.tail(project, run, logFile, "log", parseTailLogLine, time.Duration(config.StatusStream.EofSleepMs)*time.Millisecond)
+	defer release()
+	sub := tailer.subscribe(0)
+	defer sub.Close()
 
 	// Go over the log file and format it to html
-	scanner := bufio.NewScanner(chunk_pipe_rd)
 	byte_counter := 0
 	last_date := ""
 	last_time := 0.0
-	for scanner.Scan() {
-		json_line := scanner.Bytes()
-		if len(json_line) == 0 {
-			continue
+	for {
+		lines, err := sub.Next(done, closed)
+		if err != nil {
+			return
 		}
 
-		html_lines := formatJsonLogLine(json_line, &last_date, &last_time)
-		byte_counter += len(html_lines)
-		if !no_truncate && byte_counter > config.StatusStream.LogTruncationSize {
-			err := fullWrite(w, "-- LOG TRUNCATED DUE TO LENGTH, <a href=log_stream?notrunc>Click here to keep going</a> --\n")
+		for _, line := range lines {
+			log_line, ok := line.Parsed.(logLine)
+			valid := line.Valid
+			if !ok {
+				parsed, parsed_valid := parseTailLogLine(line.Data)
+				log_line, valid = parsed.(logLine), parsed_valid
+			}
+			html_lines := formatLogLine(log_line, valid, &last_date, &last_time)
+			byte_counter += len(html_lines)
+			if !no_truncate && byte_counter > config.StatusStream.LogTruncationSize {
+				fullWrite(w, "-- LOG TRUNCATED DUE TO LENGTH, <a href=log_stream?notrunc>Click here to keep going</a> --\n")
+				return
+			}
+			err = fullWrite(w, html_lines)
 			if err != nil {
 				return
 			}
-			break
-		}
-		err = fullWrite(w, html_lines)
-		if err != nil {
-			return
 		}
 
 		w.(http.Flusher).Flush()
@@ -805,8 +947,7 @@ func logTailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log_path := filepath.Join(config.ProjectsDir, project, run, logFile)
-	log_fd, err := os.Open(log_path)
+	log_fd, err := openLogFile(project, run, logFile)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -893,6 +1034,16 @@ func serveIconHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFileFS(w, r, dist, "frontend-dist/favicon.ico")
 }
 
+// Serves a storage file with support for Range and conditional requests
+func serveStorageFile(w http.ResponseWriter, r *http.Request, name string, fd storageFile) {
+	stat, err := fd.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, stat.ModTime, fd)
+}
+
 func nocache(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Cache-Control", "no-cache, no-store, no-transform, must-revalidate, private, max-age=0")
@@ -901,6 +1052,11 @@ func nocache(handler func(w http.ResponseWriter, r *http.Request)) func(w http.R
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import-junit" {
+		importJunitCommand(os.Args[2:])
+		return
+	}
+
 	var showVersion bool
 	flag.BoolVar(&showVersion, "version", false, "Show the version and exit")
 
@@ -919,6 +1075,27 @@ func main() {
 		log.Fatalln("Failed to parse config file:", err)
 	}
 
+	switch config.Storage.Backend {
+	case "fs":
+		storage = newFsStorage(config.ProjectsDir)
+	case "s3":
+		storage, err = newS3Storage(config.Storage.S3)
+		if err != nil {
+			log.Fatalln("Failed to set up s3 storage:", err)
+		}
+	default:
+		log.Fatalf("Unknown storage backend '%s'", config.Storage.Backend)
+	}
+	if config.StateDir == "" {
+		log.Printf("No state_dir set, run summaries and test results are only cached in memory")
+	}
+	if config.KnownIssues.Editable && len(config.KnownIssues.Tokens) == 0 {
+		log.Fatalf("Editable known issues need known_issues.tokens")
+	}
+	watcher = newWatcherHub()
+	startNotifications()
+	startDigests()
+
 	sub, err := fs.Sub(dist, "frontend-dist")
 	if err != nil {
 		log.Fatalln("Failed to parse config file:", err)
@@ -931,12 +1108,29 @@ func main() {
 	http.HandleFunc("GET /api/v1/version", nocache(versionHandler))
 	http.HandleFunc("GET /api/v1/projects", nocache(projectsListHandler))
 	http.HandleFunc("GET /api/v1/projects/{project}/runs", nocache(projectRunsHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/tests/{test}/history", nocache(testHistoryHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/flaky", nocache(flakyHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/compare", nocache(compareRunsHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/known_issues", nocache(knownIssuesHandler))
+	http.HandleFunc("PUT /api/v1/projects/{project}/known_issues/{rule}", nocache(knownIssuesEditable(knownIssuePutHandler)))
+	http.HandleFunc("DELETE /api/v1/projects/{project}/known_issues/{rule}", nocache(knownIssuesEditable(knownIssueDeleteHandler)))
 	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/plan", nocache(runPlanHandler))
 	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/status_summary", nocache(runStatusSummaryHandler))
 	http.HandleFunc("POST /api/v1/projects/{project}/runs/{run}/status_poll", nocache(runStatusPollHandler))
 	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/status_stream/{worker_id}", nocache(runStatusStreamHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/events", nocache(runEventsHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/failures", nocache(runFailuresHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/durations", nocache(runDurationsHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/timeline", nocache(runTimelineHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/eta", nocache(runEtaHandler))
+	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/junit.xml", nocache(runJunitHandler))
 	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/test/{test}/log_stream", nocache(logStreamHandler))
 	http.HandleFunc("GET /api/v1/projects/{project}/runs/{run}/test/{test}/log_tail", nocache(logTailHandler))
+	http.HandleFunc("POST /api/v1/projects/{project}/runs/{run}/plan", nocache(ingestAuth(ingestPlanHandler)))
+	http.HandleFunc("POST /api/v1/projects/{project}/runs/{run}/status/{worker_id}", nocache(ingestAuth(ingestStatusHandler)))
+	http.HandleFunc("POST /api/v1/projects/{project}/runs/{run}/test/{test}/log", nocache(ingestAuth(ingestLogHandler)))
+	http.HandleFunc("POST /api/v1/projects/{project}/runs/{run}/end", nocache(ingestAuth(ingestEndHandler)))
+	http.HandleFunc("POST /api/v1/projects/{project}/runs/{run}/junit", nocache(ingestAuth(ingestJunitHandler)))
 	http.HandleFunc("GET /api/", docsHandler)
 
 	// TODO: use etag caching instead of nocache
@@ -0,0 +1,27 @@
+package main
+
+import "syscall"
+
+// Filesystem magic numbers (see statfs(2)) of filesystems that don't report
+// changes made by other hosts through inotify
+var networkFilesystemMagics = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517b:     true, // SMB
+	0xff534d42: true, // CIFS
+	0xfe534d42: true, // SMB2
+	0x65735546: true, // FUSE (sshfs, s3fs, ...)
+	0x00c36400: true, // Ceph
+	0x01021997: true, // 9p
+	0x6b414653: true, // AFS
+	0x47504653: true, // GPFS
+	0x0bd00bd0: true, // Lustre
+}
+
+func isNetworkFilesystem(path string) bool {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return false
+	}
+	return networkFilesystemMagics[uint32(stat.Type)]
+}
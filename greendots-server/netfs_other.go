@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Network filesystems are only detected on Linux, elsewhere set `mode = "poll"` explicitly
+func isNetworkFilesystem(path string) bool {
+	return false
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// -- Notifications --
+//
+// The most recent runs of every project are checked every `scan_interval_ms`
+// for events, which are POSTed as JSON to the `[[notifications.webhooks]]`
+// that want them:
+// - "run_finished": the run finished.
+// - "run_stalled": nothing was written to the run for `stall_timeout_ms`.
+// - "first_failure": a test of the run failed, sent once per run.
+// - "new_failure": the run finished with tests failing that didn't fail in the previous run.
+//
+// Every delivery is recorded in a log (`notifications/deliveries.jsonl` under
+// `state_dir`), so each event is sent to each webhook once, even across
+// restarts, which is why webhooks need `state_dir`. Failed deliveries are
+// retried with exponential backoff, up to `max_attempts` times. Only events
+// that happened after notifications were first enabled are sent, so enabling
+// them doesn't send an event for every old run.
+//
+// Runs that fell out of the last `scan_runs` are never scanned again, so their
+// deliveries are forgotten, and the log is compacted on startup.
+
+const (
+	notifyRunFinished  = "run_finished"
+	notifyRunStalled   = "run_stalled"
+	notifyFirstFailure = "first_failure"
+	notifyNewFailure   = "new_failure"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// At most this many tests are listed in a notification
+const notificationMaxTests = 50
+
+type notificationTest struct {
+	Test           string `json:"test"`
+	Outcome        string `json:"outcome"`
+	ExceptionTitle string `json:"exception_title,omitempty"`
+	Url            string `json:"url"`
+}
+
+type notificationPayload struct {
+	Event    string            `json:"event"`
+	Project  string            `json:"project"`
+	Run      string            `json:"run"`
+	Url      string            `json:"url"`
+	State    string            `json:"state"`
+	Counts   *runOutcomeCounts `json:"counts"`
+	Duration float64           `json:"duration"`
+	// For "new_failure", the run it was compared with
+	PreviousRun string `json:"previous_run,omitempty"`
+	// The failed tests for "first_failure", the newly failing ones for "new_failure"
+	Tests      []notificationTest `json:"tests,omitempty"`
+	TotalTests int                `json:"total_tests,omitempty"`
+}
+
+type webhookDelivery struct {
+	// The event and the webhook it's sent to
+	Id        string          `json:"id"`
+	Project   string          `json:"project"`
+	Run       string          `json:"run"`
+	Webhook   string          `json:"webhook"`
+	Payload   json.RawMessage `json:"payload"`
+	Status    string          `json:"status"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+type notificationsState struct {
+	// When notifications were first enabled
+	Since time.Time `json:"since"`
+}
+
+var notifier = struct {
+	sync.Mutex
+	since      time.Time
+	deliveries map[string]*webhookDelivery
+}{deliveries: make(map[string]*webhookDelivery)}
+
+func notificationsPath(name string) string {
+	return filepath.Join(config.StateDir, "notifications", name)
+}
+
+func startNotifications() {
+	if len(config.Notifications.Webhooks) == 0 {
+		return
+	}
+	if config.StateDir == "" {
+		log.Fatalf("Webhook notifications need `state_dir`, to remember what was already sent")
+	}
+
+	pending := loadNotifications()
+	for _, delivery := range pending {
+		go deliverWebhook(delivery)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Notifications.ScanIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			scanNotifications()
+			<-ticker.C
+		}
+	}()
+}
+
+// Loads and compacts the delivery log, and returns the deliveries that should be retried
+func loadNotifications() []*webhookDelivery {
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	notifier.since = time.Now()
+	data, err := os.ReadFile(notificationsPath("state.json"))
+	var state notificationsState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err == nil {
+		notifier.since = state.Since
+	} else {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read the notifications state, starting over: %v", err)
+		}
+		data, err = json.Marshal(notificationsState{Since: notifier.since})
+		if err == nil {
+			err = writeStateFile(notificationsPath("state.json"), data)
+		}
+		if err != nil {
+			log.Printf("Failed to save the notifications state: %v", err)
+		}
+	}
+
+	fd, err := os.Open(notificationsPath("deliveries.jsonl"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read the notifications delivery log: %v", err)
+		}
+		return nil
+	}
+	defer fd.Close()
+
+	// Every change of a delivery is appended, the last one wins
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var delivery webhookDelivery
+		if json.Unmarshal(line, &delivery) != nil {
+			continue
+		}
+		notifier.deliveries[delivery.Id] = &delivery
+	}
+
+	projects := make(map[string]bool)
+	for _, delivery := range notifier.deliveries {
+		projects[delivery.Project] = true
+	}
+	for project := range projects {
+		runs, err := getProjectRuns(project)
+		if err == nil {
+			forgetOldDeliveries(project, runs[:min(config.Notifications.ScanRuns, len(runs))])
+		} else if errors.Is(err, fs.ErrNotExist) {
+			forgetOldDeliveries(project, nil)
+		}
+	}
+
+	ids := make([]string, 0, len(notifier.deliveries))
+	for id := range notifier.deliveries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	compacted := []byte{}
+	for _, id := range ids {
+		data, err := json.Marshal(notifier.deliveries[id])
+		if err == nil {
+			compacted = append(append(compacted, data...), '\n')
+		}
+	}
+	err = writeStateFile(notificationsPath("deliveries.jsonl"), compacted)
+	if err != nil {
+		log.Printf("Failed to compact the notifications delivery log: %v", err)
+	}
+
+	pending := []*webhookDelivery{}
+	for _, delivery := range notifier.deliveries {
+		if delivery.Status == deliveryPending {
+			pending = append(pending, delivery)
+		}
+	}
+	return pending
+}
+
+// Forgets the deliveries of the runs of a project that aren't scanned anymore,
+// unless they're still being retried. The lock must be held
+func forgetOldDeliveries(project string, scanned []run) {
+	for id, delivery := range notifier.deliveries {
+		if delivery.Project != project || delivery.Status == deliveryPending {
+			continue
+		}
+		if !slices.ContainsFunc(scanned, func(listed run) bool { return listed.Id == delivery.Run }) {
+			delete(notifier.deliveries, id)
+		}
+	}
+}
+
+// Appends the current state of a delivery to the log, the lock must be held
+func recordDelivery(delivery *webhookDelivery) {
+	delivery.UpdatedAt = time.Now()
+	data, err := json.Marshal(delivery)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(notificationsPath("deliveries.jsonl")), 0o755)
+	}
+	if err == nil {
+		var fd *os.File
+		fd, err = os.OpenFile(notificationsPath("deliveries.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err == nil {
+			err = fullWriteBytes(fd, append(data, '\n'))
+			if closeErr := fd.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record the delivery of '%s': %v", delivery.Id, err)
+	}
+}
+
+func webhookWants(webhook webhookConfig, project string, event string) bool {
+	return (len(webhook.Projects) == 0 || slices.Contains(webhook.Projects, project)) &&
+		(len(webhook.Events) == 0 || slices.Contains(webhook.Events, event))
+}
+
+func runUrl(project string, run string) string {
+	return config.Notifications.BaseUrl + "/" + url.PathEscape(project) + "/" + url.PathEscape(run)
+}
+
+func notificationTests(project string, run string, tests []string, results map[string]testResult) ([]notificationTest, int) {
+	sort.Strings(tests)
+	listed := make([]notificationTest, 0, min(len(tests), notificationMaxTests))
+	for _, test := range tests[:min(len(tests), notificationMaxTests)] {
+		listed = append(listed, notificationTest{
+			Test:           test,
+			Outcome:        results[test].Outcome,
+			ExceptionTitle: results[test].ExceptionTitle,
+			Url:            config.Notifications.BaseUrl + testLogUrl(project, run, test),
+		})
+	}
+	return listed, len(tests)
+}
+
+func deliveryId(event string, project string, run string, webhook webhookConfig) string {
+	return fmt.Sprintf("%s:%s/%s:%s", event, project, run, webhook.Url)
+}
+
+// Whether any webhook wants an event and didn't get it yet
+func shouldNotify(event string, project string, run string) bool {
+	notifier.Lock()
+	defer notifier.Unlock()
+	for _, webhook := range config.Notifications.Webhooks {
+		if !webhookWants(webhook, project, event) {
+			continue
+		}
+		if _, ok := notifier.deliveries[deliveryId(event, project, run, webhook)]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues an event for every webhook that wants it and didn't get it yet
+func notify(payload notificationPayload) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode the '%s' notification of '%s/%s': %v", payload.Event, payload.Project, payload.Run, err)
+		return
+	}
+
+	notifier.Lock()
+	defer notifier.Unlock()
+	for _, webhook := range config.Notifications.Webhooks {
+		if !webhookWants(webhook, payload.Project, payload.Event) {
+			continue
+		}
+		id := deliveryId(payload.Event, payload.Project, payload.Run, webhook)
+		if _, ok := notifier.deliveries[id]; ok {
+			continue
+		}
+		delivery := &webhookDelivery{Id: id, Project: payload.Project, Run: payload.Run, Webhook: webhook.Url, Payload: data, Status: deliveryPending}
+		notifier.deliveries[id] = delivery
+		recordDelivery(delivery)
+		go deliverWebhook(delivery)
+	}
+}
+
+func deliverWebhook(delivery *webhookDelivery) {
+	client := &http.Client{Timeout: time.Duration(config.Notifications.TimeoutMs) * time.Millisecond}
+
+	notifier.Lock()
+	attempts := delivery.Attempts
+	notifier.Unlock()
+	for {
+		if attempts > 0 {
+			backoff := time.Duration(config.Notifications.RetryBackoffMs) * time.Millisecond << min(attempts-1, 16)
+			time.Sleep(backoff)
+		}
+
+		resp, err := client.Post(delivery.Webhook, "application/json", bytes.NewReader(delivery.Payload))
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		attempts++
+
+		notifier.Lock()
+		delivery.Attempts = attempts
+		switch {
+		case err == nil:
+			delivery.Status = deliveryDelivered
+			delivery.LastError = ""
+		case attempts >= config.Notifications.MaxAttempts:
+			delivery.Status = deliveryFailed
+			delivery.LastError = err.Error()
+		default:
+			delivery.LastError = err.Error()
+		}
+		recordDelivery(delivery)
+		status := delivery.Status
+		notifier.Unlock()
+
+		if status != deliveryPending {
+			if status == deliveryFailed {
+				log.Printf("Giving up on delivering '%s' after %d attempts: %v", delivery.Id, attempts, err)
+			}
+			return
+		}
+	}
+}
+
+func scanNotifications() {
+	notifier.Lock()
+	since := notifier.since
+	notifier.Unlock()
+
+	projects, err := storage.ListProjects()
+	if err != nil {
+		log.Printf("Failed to list the projects for notifications: %v", err)
+		return
+	}
+	for _, project := range projects {
+		if !slices.ContainsFunc(config.Notifications.Webhooks, func(webhook webhookConfig) bool {
+			return len(webhook.Projects) == 0 || slices.Contains(webhook.Projects, project)
+		}) {
+			continue
+		}
+
+		runs, err := getProjectRuns(project)
+		if err != nil {
+			continue
+		}
+		scanned := runs[:min(config.Notifications.ScanRuns, len(runs))]
+		for i, listed := range scanned {
+			scanRunNotifications(project, listed, previousFinishedRun(project, runs, i), since)
+		}
+
+		notifier.Lock()
+		forgetOldDeliveries(project, scanned)
+		notifier.Unlock()
+	}
+}
+
+// The most recent finished run before runs[i], new failures are relative to
+// it since unfinished runs are still missing outcomes
+func previousFinishedRun(project string, runs []run, i int) *run {
+	for j := i + 1; j < len(runs); j++ {
+		created, _ := time.Parse(time.RFC3339, runs[j].CreatedAt)
+		if getRunSummary(project, runs[j].Id, created).State == runStateFinished {
+			return &runs[j]
+		}
+	}
+	return nil
+}
+
+func scanRunNotifications(project string, listed run, previous *run, since time.Time) {
+	created, err := time.Parse(time.RFC3339, listed.CreatedAt)
+	if err != nil {
+		created = time.Time{}
+	}
+	summary := getRunSummary(project, listed.Id, created)
+	payload := notificationPayload{
+		Project:  project,
+		Run:      listed.Id,
+		Url:      runUrl(project, listed.Id),
+		State:    summary.State,
+		Counts:   summary.Counts,
+		Duration: summary.Duration,
+	}
+
+	stall_timeout := time.Duration(config.Lifecycle.StallTimeoutMs) * time.Millisecond
+	switch {
+	case summary.State == runStateFinished && !summary.LastActivity.Before(since):
+		payload.Event = notifyRunFinished
+		notify(payload)
+	case summary.State == runStateStalled && !summary.LastActivity.Add(stall_timeout).Before(since):
+		payload.Event = notifyRunStalled
+		notify(payload)
+	}
+	if summary.Counts == nil || summary.LastActivity.Before(since) {
+		return
+	}
+
+	if summary.Counts.Failed+summary.Counts.Error > 0 && shouldNotify(notifyFirstFailure, project, listed.Id) {
+		results, err := getRunTestResults(project, listed.Id, created)
+		if err == nil {
+			failed := []string{}
+			for test, result := range results {
+				if isFailingOutcome(result.Outcome) {
+					failed = append(failed, test)
+				}
+			}
+			payload.Event = notifyFirstFailure
+			payload.Tests, payload.TotalTests = notificationTests(project, listed.Id, failed, results)
+			notify(payload)
+		}
+	}
+
+	if summary.State == runStateFinished && previous != nil && shouldNotify(notifyNewFailure, project, listed.Id) {
+		results, err := getRunTestResults(project, listed.Id, created)
+		if err != nil {
+			return
+		}
+		previous_created, err := time.Parse(time.RFC3339, previous.CreatedAt)
+		if err != nil {
+			previous_created = time.Time{}
+		}
+		previous_results, err := getRunTestResults(project, previous.Id, previous_created)
+		if err != nil {
+			return
+		}
+		newly_failing := []string{}
+		for _, entry := range compareRuns(previous_results, results).NewlyFailing {
+			newly_failing = append(newly_failing, entry.Test)
+		}
+		if len(newly_failing) > 0 {
+			payload.Event = notifyNewFailure
+			payload.PreviousRun = previous.Id
+			payload.Tests, payload.TotalTests = notificationTests(project, listed.Id, newly_failing, results)
+			notify(payload)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Points the server at empty projects and state directories, for the duration of the test
+func useTestProjects(t *testing.T) string {
+	prev_config, prev_storage := config, storage
+	t.Cleanup(func() { config, storage = prev_config, prev_storage })
+
+	config.ProjectsDir = t.TempDir()
+	config.StateDir = t.TempDir()
+	storage = newFsStorage(config.ProjectsDir)
+	return config.ProjectsDir
+}
+
+// Writes a run as the pytest plugin would, with the given final outcome of
+// each test. Tests without an outcome are left running, and the run only
+// gets an end marker if every test finished.
+func writeTestRun(t *testing.T, project string, run string, created time.Time, outcomes map[string]string) {
+	run_dir := filepath.Join(config.ProjectsDir, project, run)
+	err := os.MkdirAll(run_dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := make([]string, 0, len(outcomes))
+	for test := range outcomes {
+		tests = append(tests, test)
+	}
+	sort.Strings(tests)
+
+	plan := runPlan{WorkerCount: 1, Groups: map[string][]runPlanTestItem{"tests": {}}, RowParams: []string{}}
+	var statuses bytes.Buffer
+	finished := true
+	for i, test := range tests {
+		plan.Groups["tests"] = append(plan.Groups["tests"], runPlanTestItem{Id: test, LogFile: test + ".log.jsonl", Name: test, Params: map[string]interface{}{}})
+		test_time := float64(created.Unix() + int64(i))
+		fmt.Fprintf(&statuses, "{\"type\": \"start\", \"test\": %q, \"time\": %v}\n", test, test_time)
+		if outcomes[test] == "" {
+			finished = false
+			continue
+		}
+		exception := ""
+		if outcomes[test] == "failed" {
+			exception = "AssertionError: " + test
+		}
+		fmt.Fprintf(&statuses, "{\"type\": \"call\", \"test\": %q, \"outcome\": %q, \"exception\": %q, \"time\": %v}\n", test, outcomes[test], exception, test_time+0.5)
+		fmt.Fprintf(&statuses, "{\"type\": \"finish\", \"test\": %q, \"outcome\": %q, \"time\": %v}\n", test, outcomes[test], test_time+0.5)
+	}
+
+	plan_data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"plan.json": plan_data, statusFileName(0): statuses.Bytes()}
+	if finished {
+		files[runEndMarker] = []byte("{}")
+	}
+	for name, data := range files {
+		err = os.WriteFile(filepath.Join(run_dir, name), data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Chtimes(run_dir, created, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A webhook that fails the first request of each event in `fail_once`
+type testWebhook struct {
+	mu       sync.Mutex
+	failOnce map[string]bool
+	requests int
+	received map[string][]notificationPayload
+}
+
+func (h *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var payload notificationPayload
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &payload) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	if h.failOnce[payload.Event] {
+		delete(h.failOnce, payload.Event)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	h.received[payload.Event] = append(h.received[payload.Event], payload)
+}
+
+func (h *testWebhook) count() (int, map[string]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[string]int)
+	for event, payloads := range h.received {
+		counts[event] = len(payloads)
+	}
+	return h.requests, counts
+}
+
+func resetNotifier() {
+	notifier.Lock()
+	notifier.deliveries = make(map[string]*webhookDelivery)
+	notifier.Unlock()
+}
+
+func waitForDeliveries(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		notifier.Lock()
+		pending := 0
+		for _, delivery := range notifier.deliveries {
+			if delivery.Status == deliveryPending {
+				pending++
+			}
+		}
+		notifier.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d deliveries still pending", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookNotifications(t *testing.T) {
+	useTestProjects(t)
+	t.Cleanup(resetNotifier)
+	webhook := &testWebhook{failOnce: map[string]bool{notifyFirstFailure: true}, received: make(map[string][]notificationPayload)}
+	server := httptest.NewServer(webhook)
+	t.Cleanup(server.Close)
+
+	config.Notifications.BaseUrl = "http://greendots.test"
+	config.Notifications.Webhooks = []webhookConfig{{Url: server.URL}}
+	config.Notifications.RetryBackoffMs = 10
+	config.Notifications.MaxAttempts = 3
+	config.Lifecycle.StallTimeoutMs = 1
+
+	resetNotifier()
+	if pending := loadNotifications(); len(pending) != 0 {
+		t.Fatalf("pending deliveries of an empty log: %v", pending)
+	}
+	notifier.Lock()
+	notifier.since = time.Now().Add(-time.Minute)
+	notifier.Unlock()
+
+	project := "notify"
+	now := time.Now()
+	writeTestRun(t, project, "run-1", now.Add(-3*time.Minute), map[string]string{"test_a": "passed", "test_b": "passed"})
+	writeTestRun(t, project, "run-2", now.Add(-2*time.Minute), map[string]string{"test_a": "passed", "test_b": "failed"})
+	writeTestRun(t, project, "run-3", now.Add(-1*time.Minute), map[string]string{"test_a": "passed", "test_b": ""})
+	// Compared with run-2, where test_b already failed, not with the unfinished run-3
+	writeTestRun(t, project, "run-4", now.Add(-30*time.Second), map[string]string{"test_a": "passed", "test_b": "failed"})
+	time.Sleep(10 * time.Millisecond)
+
+	scanNotifications()
+	waitForDeliveries(t)
+
+	requests, counts := webhook.count()
+	expected := map[string]int{notifyRunFinished: 3, notifyFirstFailure: 2, notifyNewFailure: 1, notifyRunStalled: 1}
+	if fmt.Sprint(counts) != fmt.Sprint(expected) {
+		t.Fatalf("received %v, expected %v", counts, expected)
+	}
+	// The first failure was sent twice, the first attempt got a 500
+	if requests != 8 {
+		t.Fatalf("%d requests, expected 8", requests)
+	}
+
+	webhook.mu.Lock()
+	stalled := webhook.received[notifyRunStalled][0]
+	new_failure := webhook.received[notifyNewFailure][0]
+	first_failure := webhook.received[notifyFirstFailure][0]
+	if first_failure.Run != "run-2" {
+		first_failure = webhook.received[notifyFirstFailure][1]
+	}
+	webhook.mu.Unlock()
+	if stalled.Run != "run-3" || stalled.State != runStateStalled {
+		t.Errorf("unexpected run_stalled: %+v", stalled)
+	}
+	if new_failure.Run != "run-2" || new_failure.PreviousRun != "run-1" || len(new_failure.Tests) != 1 || new_failure.Tests[0].Test != "test_b" {
+		t.Errorf("unexpected new_failure: %+v", new_failure)
+	}
+	if first_failure.Run != "run-2" || first_failure.TotalTests != 1 || first_failure.Tests[0].ExceptionTitle != "AssertionError: test_b" {
+		t.Errorf("unexpected first_failure: %+v", first_failure)
+	}
+	if !strings.HasPrefix(first_failure.Url, "http://greendots.test/notify/run-2") {
+		t.Errorf("unexpected url: %s", first_failure.Url)
+	}
+
+	// Nothing is sent again once the log is reloaded, as after a restart
+	resetNotifier()
+	if pending := loadNotifications(); len(pending) != 0 {
+		t.Fatalf("pending deliveries after reload: %v", pending)
+	}
+	scanNotifications()
+	waitForDeliveries(t)
+	time.Sleep(50 * time.Millisecond)
+	if again, _ := webhook.count(); again != requests {
+		t.Fatalf("%d more requests after reload", again-requests)
+	}
+
+	// Only the deliveries of the scanned runs are kept when compacting
+	config.Notifications.ScanRuns = 1
+	resetNotifier()
+	loadNotifications()
+	data, err := os.ReadFile(notificationsPath("deliveries.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "\"run\":\"run-4\"") || !strings.Contains(lines[1], "\"run\":\"run-4\"") {
+		t.Fatalf("unexpected compacted log: %q", lines)
+	}
+	scanNotifications()
+	time.Sleep(50 * time.Millisecond)
+	if again, _ := webhook.count(); again != requests {
+		t.Fatalf("%d more requests after compacting", again-requests)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// -- Run plan cache --
+//
+// Decoded plans are kept in an LRU bounded by the total size of their
+// plan.json files. A cached plan is trusted for `plan_cache_ms`, after which
+// the size and mtime of plan.json are checked again before reusing it.
+// Concurrent requests for a plan that isn't cached wait for a single decode.
+//
+// Cached plans are shared, so callers must never modify them.
+
+type runPlanCacheKey struct {
+	project string
+	run     string
+}
+
+type runPlanCacheEntry struct {
+	key       runPlanCacheKey
+	plan      *runPlan
+	info      storageFileInfo
+	checkedAt time.Time
+	elem      *list.Element
+}
+
+type runPlanLoad struct {
+	done chan struct{}
+	plan *runPlan
+	err  error
+}
+
+type runPlanCacheT struct {
+	mu       sync.Mutex
+	entries  map[runPlanCacheKey]*runPlanCacheEntry
+	lru      *list.List
+	bytes    int64
+	inflight map[runPlanCacheKey]*runPlanLoad
+}
+
+var runPlanCache = &runPlanCacheT{
+	entries:  make(map[runPlanCacheKey]*runPlanCacheEntry),
+	lru:      list.New(),
+	inflight: make(map[runPlanCacheKey]*runPlanLoad),
+}
+
+func (c *runPlanCacheT) get(key runPlanCacheKey) (*runPlan, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		if time.Since(entry.checkedAt) < time.Duration(config.Caching.PlanCacheMs)*time.Millisecond {
+			c.lru.MoveToFront(entry.elem)
+			c.mu.Unlock()
+			return entry.plan, nil
+		}
+
+		// Check whether the plan changed since it was cached
+		c.mu.Unlock()
+		info, err := storage.StatRunFile(key.project, key.run, "plan.json")
+		c.mu.Lock()
+		if err == nil && info == entry.info && c.entries[key] == entry {
+			entry.checkedAt = time.Now()
+			c.lru.MoveToFront(entry.elem)
+			c.mu.Unlock()
+			return entry.plan, nil
+		}
+		c.removeLocked(key)
+	}
+
+	// Someone is already decoding this plan, wait for them
+	if load, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-load.done
+		return load.plan, load.err
+	}
+	load := &runPlanLoad{done: make(chan struct{})}
+	c.inflight[key] = load
+	c.mu.Unlock()
+
+	var info storageFileInfo
+	load.plan, info, load.err = loadRunPlan(key.project, key.run)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if load.err == nil {
+		c.addLocked(key, load.plan, info)
+	}
+	c.mu.Unlock()
+	close(load.done)
+
+	return load.plan, load.err
+}
+
+func loadRunPlan(project string, run string) (*runPlan, storageFileInfo, error) {
+	planFd, err := openRunPlan(project, run)
+	if err != nil {
+		return nil, storageFileInfo{}, err
+	}
+	defer planFd.Close()
+
+	info, err := planFd.Stat()
+	if err != nil {
+		return nil, storageFileInfo{}, err
+	}
+
+	var plan runPlan
+	err = json.NewDecoder(planFd).Decode(&plan)
+	if err != nil {
+		log.Printf("Failed to decode plan file of '%s/%s': %v", project, run, err)
+		return nil, storageFileInfo{}, err
+	}
+	return &plan, info, nil
+}
+
+func (c *runPlanCacheT) addLocked(key runPlanCacheKey, plan *runPlan, info storageFileInfo) {
+	c.removeLocked(key)
+
+	entry := &runPlanCacheEntry{
+		key:       key,
+		plan:      plan,
+		info:      info,
+		checkedAt: time.Now(),
+	}
+	entry.elem = c.lru.PushFront(entry)
+	c.entries[key] = entry
+	c.bytes += info.Size
+
+	// Evict the least recently used plans, but always keep the newest one
+	for c.bytes > config.Caching.PlanCacheMaxBytes && c.lru.Len() > 1 {
+		oldest := c.lru.Back().Value.(*runPlanCacheEntry)
+		c.removeLocked(oldest.key)
+	}
+}
+
+func (c *runPlanCacheT) removeLocked(key runPlanCacheKey) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(entry.elem)
+	delete(c.entries, key)
+	c.bytes -= entry.info.Size
+}
+
+func (c *runPlanCacheT) invalidate(key runPlanCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+)
+
+// -- Run lifecycle --
+//
+// A run is finished once it has an end marker (`end.json`, written by the
+// pytest plugin at the end of the session), or once every planned test
+// reached `finish`. Otherwise it is running as long as its status files keep
+// being written to, stalled after `stall_timeout_ms` without any writes, and
+// abandoned after `abandon_timeout_ms`.
+
+const (
+	runStateRunning   = "running"
+	runStateFinished  = "finished"
+	runStateStalled   = "stalled"
+	runStateAbandoned = "abandoned"
+)
+
+const runEndMarker = "end.json"
+
+// Returns the state of an unfinished run by how long ago it was last written to
+func unfinishedRunState(lastActivity time.Time) string {
+	idle := time.Since(lastActivity)
+	switch {
+	case idle < time.Duration(config.Lifecycle.StallTimeoutMs)*time.Millisecond:
+		return runStateRunning
+	case idle < time.Duration(config.Lifecycle.AbandonTimeoutMs)*time.Millisecond:
+		return runStateStalled
+	default:
+		return runStateAbandoned
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -- Run summaries --
+//
+// The lifecycle state, outcome counts and duration of a run, as shown in the
+// runs listings. Computing it means reading all of the status files, so once a
+// run is finished its summary is kept in memory and saved under `state_dir`,
+// and never computed again. The summaries of unfinished runs are kept for
+// `listing_cache_ms`, so listings don't go over every running run each time.
+// Stalled and abandoned runs may stay that way forever, so their summaries
+// are then kept for as long as they're listed, and only computed again once
+// the size or modification time of one of their files changes.
+
+// Bumped whenever the saved summaries should be computed again
+const runSummaryVersion = 1
+
+type runOutcomeCounts struct {
+	Passed     int `json:"passed"`
+	Failed     int `json:"failed"`
+	Skipped    int `json:"skipped"`
+	Error      int `json:"error"`
+	Running    int `json:"running"`
+	NotStarted int `json:"not_started"`
+}
+
+type runSummary struct {
+	Version      int       `json:"version"`
+	State        string    `json:"state"`
+	LastActivity time.Time `json:"last_activity"`
+	// nil if the run has no plan
+	Counts *runOutcomeCounts `json:"counts"`
+	// Seconds between the first and last status of the run
+	Duration float64 `json:"duration"`
+}
+
+type unfinishedRunSummary struct {
+	summary runSummary
+	// See runFilesStamp, empty for running runs
+	stamp     string
+	expiresAt time.Time
+	lastUsed  time.Time
+}
+
+type runSummaryCacheT struct {
+	mu         sync.Mutex
+	finished   map[runPlanCacheKey]runSummary
+	unfinished map[runPlanCacheKey]unfinishedRunSummary
+}
+
+var runSummaryCache = &runSummaryCacheT{
+	finished:   make(map[runPlanCacheKey]runSummary),
+	unfinished: make(map[runPlanCacheKey]unfinishedRunSummary),
+}
+
+func runSummaryPath(project string, run string) string {
+	return filepath.Join(config.StateDir, "summaries", project, run+".json")
+}
+
+// Returns the summary of a run, see above. `created` is the modification
+// time of the run, used when nothing was written yet.
+func getRunSummary(project string, run string, created time.Time) runSummary {
+	key := runPlanCacheKey{project, run}
+	if summary, ok := runSummaryCache.load(key); ok {
+		return summary
+	}
+
+	// Runs that weren't running last time are only computed again if their files changed
+	stamp := ""
+	if cached, ok := runSummaryCache.loadExpired(key); !ok || cached.stamp != "" {
+		stamp = runFilesStamp(project, run)
+		if ok && stamp == cached.stamp {
+			summary := cached.summary
+			summary.State = unfinishedRunState(summary.LastActivity)
+			runSummaryCache.storeUnfinished(key, summary, stamp)
+			return summary
+		}
+	}
+
+	summary := computeRunSummary(project, run, created)
+	switch summary.State {
+	case runStateFinished:
+		runSummaryCache.store(key, summary)
+	case runStateRunning:
+		runSummaryCache.storeUnfinished(key, summary, "")
+	default:
+		runSummaryCache.storeUnfinished(key, summary, stamp)
+	}
+	if summary.State != runStateRunning {
+		// Its status files are rarely read again, see status_cache.go
+		statusSummaryCache.forgetRun(project, run)
+	}
+	return summary
+}
+
+// Identifies the contents of the files a run summary is computed from, by
+// their sizes and modification times. Taken before computing the summary, so
+// anything written meanwhile changes it.
+func runFilesStamp(project string, run string) string {
+	var stamp strings.Builder
+	add := func(info storageFileInfo, err error) {
+		if err != nil {
+			stamp.WriteString("-;")
+			return
+		}
+		fmt.Fprintf(&stamp, "%d@%d;", info.Size, info.ModTime.UnixNano())
+	}
+
+	add(storage.StatRunFile(project, run, "plan.json"))
+	add(storage.StatRunFile(project, run, runEndMarker))
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		return stamp.String()
+	}
+	for i := 0; i < plan.WorkerCount; i++ {
+		add(statStatusFile(project, run, i))
+	}
+	return stamp.String()
+}
+
+func computeRunSummary(project string, run string, created time.Time) runSummary {
+	summary := runSummary{Version: runSummaryVersion, LastActivity: created}
+
+	end_info, err := storage.StatRunFile(project, run, runEndMarker)
+	has_end_marker := err == nil
+	if has_end_marker {
+		summary.LastActivity = end_info.ModTime
+	}
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		summary.State = runStateFinished
+		if !has_end_marker {
+			summary.State = unfinishedRunState(summary.LastActivity)
+		}
+		return summary
+	}
+
+	snapshots := getStatusSnapshots(project, run, plan)
+	first_time, last_time := 0.0, 0.0
+	for i, snapshot := range snapshots {
+		if snapshot.FirstTime != 0 && (first_time == 0 || snapshot.FirstTime < first_time) {
+			first_time = snapshot.FirstTime
+		}
+		last_time = max(last_time, snapshot.LastTime)
+
+		info, err := statStatusFile(project, run, i)
+		if err == nil && info.ModTime.After(summary.LastActivity) {
+			summary.LastActivity = info.ModTime
+		}
+	}
+	summary.Duration = last_time - first_time
+
+	counts := &runOutcomeCounts{}
+	lost := 0
+	for _, result := range computeTestResults(plan, snapshots) {
+		if result.Lost != "" {
+			lost++
+		}
+		switch result.Outcome {
+		case testOutcomeNotStarted:
+			counts.NotStarted++
+		case testOutcomeRunning:
+			counts.Running++
+		case "passed":
+			counts.Passed++
+		case "failed":
+			counts.Failed++
+		case "skipped":
+			counts.Skipped++
+		default:
+			counts.Error++
+		}
+	}
+	summary.Counts = counts
+
+	// A hung test may still finish, so only the end marker finishes a run with lost tests
+	all_finished := counts.NotStarted == 0 && counts.Running == 0 && lost == 0 && *counts != (runOutcomeCounts{})
+	switch {
+	case has_end_marker || all_finished:
+		summary.State = runStateFinished
+	default:
+		summary.State = unfinishedRunState(summary.LastActivity)
+	}
+	return summary
+}
+
+func (c *runSummaryCacheT) load(key runPlanCacheKey) (runSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if summary, ok := c.finished[key]; ok {
+		return summary, true
+	}
+	if cached, ok := c.unfinished[key]; ok && time.Now().Before(cached.expiresAt) {
+		cached.lastUsed = time.Now()
+		c.unfinished[key] = cached
+		return cached.summary, true
+	}
+	if config.StateDir == "" {
+		return runSummary{}, false
+	}
+
+	data, err := os.ReadFile(runSummaryPath(key.project, key.run))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read the summary of '%s/%s': %v", key.project, key.run, err)
+		}
+		return runSummary{}, false
+	}
+	var summary runSummary
+	err = json.Unmarshal(data, &summary)
+	if err != nil || summary.Version != runSummaryVersion {
+		return runSummary{}, false
+	}
+	c.finished[key] = summary
+	return summary, true
+}
+
+func (c *runSummaryCacheT) store(key runPlanCacheKey, summary runSummary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.finished[key] = summary
+	delete(c.unfinished, key)
+	if config.StateDir == "" {
+		return
+	}
+
+	data, err := json.Marshal(summary)
+	if err == nil {
+		err = writeStateFile(runSummaryPath(key.project, key.run), data)
+	}
+	if err != nil {
+		log.Printf("Failed to save the summary of '%s/%s': %v", key.project, key.run, err)
+	}
+}
+
+// Returns the summary of an unfinished run even once it expired
+func (c *runSummaryCacheT) loadExpired(key runPlanCacheKey) (unfinishedRunSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.unfinished[key]
+	return cached, ok
+}
+
+func (c *runSummaryCacheT) storeUnfinished(key runPlanCacheKey, summary runSummary, stamp string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Stamped summaries outlive their expiry, until they weren't used for `summary_idle_ms`
+	now := time.Now()
+	idle := time.Duration(config.Caching.SummaryIdleMs) * time.Millisecond
+	for cached_key, cached := range c.unfinished {
+		if (cached.stamp == "" && !now.Before(cached.expiresAt)) || now.Sub(cached.lastUsed) > idle {
+			delete(c.unfinished, cached_key)
+		}
+	}
+	c.unfinished[key] = unfinishedRunSummary{
+		summary:   summary,
+		stamp:     stamp,
+		expiresAt: now.Add(time.Duration(config.Caching.ListingCacheMs) * time.Millisecond),
+		lastUsed:  now,
+	}
+}
+
+// Forgets everything saved about a run that changed after it was finished
+func forgetFinishedRun(project string, run string) {
+	runSummaryCache.forget(runPlanCacheKey{project, run})
+	forgetTestResults(runPlanCacheKey{project, run})
+}
+
+func (c *runSummaryCacheT) forget(key runPlanCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.finished, key)
+	delete(c.unfinished, key)
+	if config.StateDir == "" {
+		return
+	}
+	err := os.Remove(runSummaryPath(key.project, key.run))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove the summary of '%s/%s': %v", key.project, key.run, err)
+	}
+}
+
+// Writes a file under `state_dir` through a temporary file, creating its directory if needed
+func writeStateFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	tmpFd, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFd.Name())
+	err = fullWriteBytes(tmpFd, data)
+	if closeErr := tmpFd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFd.Name(), path)
+	}
+	return err
+}
+
+// Fills in the metadata and summary of listed runs
+func fillRunDetails(project string, runs []run) {
+	for i := range runs {
+		metadata, err := getRunMetadata(project, runs[i].Id)
+		if err != nil {
+			metadata = nil
+		}
+		runs[i].Metadata = metadata
+
+		created, err := time.Parse(time.RFC3339, runs[i].CreatedAt)
+		if err != nil {
+			created = time.Time{}
+		}
+		summary := getRunSummary(project, runs[i].Id, created)
+		runs[i].State = summary.State
+		runs[i].LastActivity = summary.LastActivity.Format(time.RFC3339)
+		runs[i].Counts = summary.Counts
+		runs[i].Duration = summary.Duration
+
+		if summary.State == runStateRunning {
+			report, err := getRunEta(project, runs[i].Id)
+			if err == nil {
+				runs[i].Eta = &report.runEta
+			}
+		}
+	}
+}
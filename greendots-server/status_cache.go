@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// -- Status summary cache --
+//
+// The summary of each status file (the last status of every test) is kept
+// along with the offset it was computed at, so later requests only parse the
+// lines appended since. The state of a run is dropped once nobody asked for
+// its summary for `summary_idle_ms`, or as soon as the run stopped running and
+// its run summary was computed (see run_summary.go).
+//
+// Snapshots share their maps and timeline with the state instead of copying
+// them, so they must never be modified. The state copies them before parsing
+// new lines instead, only once per change of the file.
+
+type statusSummaryKey struct {
+	project  string
+	run      string
+	workerId int
+}
+
+type statusSummaryState struct {
+	mu       sync.Mutex
+	statuses map[string]map[string]interface{}
+	// Time of the last "start" of each test, and the durations of its phases since
+	started map[string]float64
+	phases  map[string]testPhaseTimes
+	// Tests that failed at some point, and the ones that passed after that
+	// (e.g. rerun by pytest-rerunfailures, or by running the same run again)
+	failed        map[string]bool
+	passedOnRerun map[string]bool
+	// Every test the worker ran, in order
+	timeline []timelineTest
+	offset   int64
+	modTime  time.Time
+	// Range of the "time" fields seen so far, zero if none
+	firstTime float64
+	lastTime  float64
+	// The maps and timeline are shared with a snapshot, see above
+	shared bool
+	// Guarded by the cache lock instead, so finding idle states never waits
+	// on a state that is being updated
+	lastUsed time.Time
+}
+
+type statusSnapshot struct {
+	Statuses      map[string]map[string]interface{}
+	Started       map[string]float64
+	Phases        map[string]testPhaseTimes
+	PassedOnRerun map[string]bool
+	Timeline      []timelineTest
+	Offset        int64
+	// When the status file was last written to
+	ModTime   time.Time
+	FirstTime float64
+	LastTime  float64
+}
+
+type statusSummaryCacheT struct {
+	mu        sync.Mutex
+	entries   map[statusSummaryKey]*statusSummaryState
+	lastSweep time.Time
+}
+
+var statusSummaryCache = &statusSummaryCacheT{
+	entries: make(map[statusSummaryKey]*statusSummaryState),
+}
+
+func (c *statusSummaryCacheT) state(key statusSummaryKey) *statusSummaryState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop the state of idle runs, at most once per `summary_idle_ms`
+	now := time.Now()
+	idle := time.Duration(config.Caching.SummaryIdleMs) * time.Millisecond
+	if now.Sub(c.lastSweep) > idle {
+		c.lastSweep = now
+		for other_key, state := range c.entries {
+			if now.Sub(state.lastUsed) > idle {
+				delete(c.entries, other_key)
+			}
+		}
+	}
+
+	state, ok := c.entries[key]
+	if !ok {
+		state = &statusSummaryState{
+			statuses:      make(map[string]map[string]interface{}),
+			started:       make(map[string]float64),
+			phases:        make(map[string]testPhaseTimes),
+			failed:        make(map[string]bool),
+			passedOnRerun: make(map[string]bool),
+		}
+		c.entries[key] = state
+	}
+	state.lastUsed = now
+	return state
+}
+
+// Drops the states of a run, once nothing needs them anymore
+func (c *statusSummaryCacheT) forgetRun(project string, run string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if key.project == project && key.run == run {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Returns the summary of a status file, after parsing whatever was appended
+// to it since the last call. The snapshot must not be modified, see above
+func (c *statusSummaryCacheT) get(project string, run string, worker_id int) statusSnapshot {
+	state := c.state(statusSummaryKey{project, run, worker_id})
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	// open the status file, if not found just ignore it
+	fd, err := openStatusFile(project, run, worker_id)
+	if err == nil {
+		state.update(fd)
+		fd.Close()
+	}
+
+	state.shared = true
+	return statusSnapshot{
+		Statuses:      state.statuses,
+		Started:       state.started,
+		Phases:        state.phases,
+		PassedOnRerun: state.passedOnRerun,
+		Timeline:      state.timeline,
+		Offset:        state.offset,
+		ModTime:       state.modTime,
+		FirstTime:     state.firstTime,
+		LastTime:      state.lastTime,
+	}
+}
+
+func (state *statusSummaryState) update(fd storageFile) {
+	// A file shorter than what we already parsed was replaced, start over
+	info, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	state.modTime = info.ModTime
+	if info.Size < state.offset {
+		state.statuses = make(map[string]map[string]interface{})
+		state.started = make(map[string]float64)
+		state.phases = make(map[string]testPhaseTimes)
+		state.failed = make(map[string]bool)
+		state.passedOnRerun = make(map[string]bool)
+		state.timeline = nil
+		state.offset = 0
+		state.firstTime = 0
+		state.lastTime = 0
+		state.shared = false
+	}
+	if info.Size == state.offset {
+		return
+	}
+
+	_, err = fd.Seek(state.offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// Probably a partial line, it will be parsed once it's complete
+			return
+		}
+		if len(line) == 1 {
+			return
+		}
+
+		var status_obj map[string]interface{}
+		err = json.Unmarshal(line, &status_obj)
+		if err != nil {
+			return
+		}
+		state.unshare()
+
+		// Store the final status of each test
+		key, has_key := status_obj["test"].(string)
+		if has_key {
+			if prev_status, ok := state.statuses[key]; ok {
+				for _, field := range []string{"exception", "reason"} {
+					if prev_status[field] != nil && status_obj[field] == nil {
+						status_obj[field] = prev_status[field]
+					}
+				}
+			}
+			state.statuses[key] = status_obj
+
+			switch status_obj["outcome"] {
+			case "failed", "error", "rerun":
+				state.failed[key] = true
+			case "passed":
+				if status_obj["type"] == "finish" && state.failed[key] {
+					state.passedOnRerun[key] = true
+				}
+			}
+		}
+		if status_time, ok := status_obj["time"].(float64); ok {
+			if has_key {
+				state.updatePhases(key, status_obj, status_time)
+				state.updateTimeline(key, status_obj, status_time)
+			}
+			if state.firstTime == 0 || status_time < state.firstTime {
+				state.firstTime = status_time
+			}
+			state.lastTime = max(state.lastTime, status_time)
+		}
+
+		state.offset += int64(len(line))
+	}
+}
+
+// Copies everything a snapshot may hold before it's changed
+func (state *statusSummaryState) unshare() {
+	if !state.shared {
+		return
+	}
+	state.statuses = maps.Clone(state.statuses)
+	state.started = maps.Clone(state.started)
+	state.phases = maps.Clone(state.phases)
+	state.passedOnRerun = maps.Clone(state.passedOnRerun)
+	state.timeline = slices.Clone(state.timeline)
+	state.shared = false
+}
+
+// Seconds spent in each phase of a test, from the "duration" of the phase
+// statuses, or from the time between them for older plugins
+type testPhaseTimes struct {
+	Setup    float64
+	Call     float64
+	Teardown float64
+	// Time of the last status of the test
+	last float64
+}
+
+func (state *statusSummaryState) updatePhases(test string, status_obj map[string]interface{}, status_time float64) {
+	if status_obj["type"] == "start" {
+		state.started[test] = status_time
+		state.phases[test] = testPhaseTimes{last: status_time}
+		return
+	}
+
+	phases, ok := state.phases[test]
+	if !ok {
+		return
+	}
+	duration, ok := status_obj["duration"].(float64)
+	if !ok {
+		duration = max(status_time-phases.last, 0)
+	}
+	switch status_obj["type"] {
+	case "setup":
+		phases.Setup = duration
+	case "call":
+		phases.Call = duration
+	case "teardown":
+		phases.Teardown = duration
+	}
+	phases.last = status_time
+	state.phases[test] = phases
+}
+
+type timelineTest struct {
+	Test  string  `json:"test"`
+	Start float64 `json:"start"`
+	// Zero while the test is running
+	End     float64 `json:"end"`
+	Outcome string  `json:"outcome"`
+}
+
+func (state *statusSummaryState) updateTimeline(test string, status_obj map[string]interface{}, status_time float64) {
+	switch status_obj["type"] {
+	case "start":
+		state.timeline = append(state.timeline, timelineTest{Test: test, Start: status_time, Outcome: testOutcomeRunning})
+	case "finish":
+		for i := len(state.timeline) - 1; i >= 0; i-- {
+			if state.timeline[i].Test == test && state.timeline[i].End == 0 {
+				state.timeline[i].End = status_time
+				state.timeline[i].Outcome, _ = status_obj["outcome"].(string)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// -- Storage --
+//
+// All reads of projects and runs go through a storageBackend, so runs can be
+// served from somewhere other than a local `projects_dir`.
+// Missing projects, runs and files are reported with errors matching fs.ErrNotExist.
+
+type storageFileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+type storageRunInfo struct {
+	Id      string
+	ModTime time.Time
+}
+
+// A file opened from a storage backend. Seeking is how ranged reads are done,
+// and reading past EOF again must pick up data appended since.
+type storageFile interface {
+	io.ReadSeekCloser
+	Stat() (storageFileInfo, error)
+}
+
+type storageBackend interface {
+	ListProjects() ([]string, error)
+	ListRuns(project string) ([]storageRunInfo, error)
+	OpenProjectFile(project string, name string) (storageFile, error)
+	OpenRunFile(project string, run string, name string) (storageFile, error)
+	StatRunFile(project string, run string, name string) (storageFileInfo, error)
+}
+
+var storage storageBackend
+
+func statusFileName(worker_id int) string {
+	return fmt.Sprintf("status.%d.jsonl", worker_id)
+}
+
+func openRunPlan(project string, run string) (storageFile, error) {
+	return storage.OpenRunFile(project, run, "plan.json")
+}
+
+// Status and log files may have been compressed once the run finished, see compression.go
+
+func openStatusFile(project string, run string, worker_id int) (storageFile, error) {
+	return openRunFileMaybeCompressed(project, run, statusFileName(worker_id))
+}
+
+func statStatusFile(project string, run string, worker_id int) (storageFileInfo, error) {
+	return statRunFileMaybeCompressed(project, run, statusFileName(worker_id))
+}
+
+func openLogFile(project string, run string, logFile string) (storageFile, error) {
+	return openRunFileMaybeCompressed(project, run, logFile)
+}
+
+// Computes the result of an io.Seeker.Seek call on a file of a known size
+func seekOffset(current int64, size int64, offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = current + offset
+	case io.SeekEnd:
+		newOffset = size + offset
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	return newOffset, nil
+}
+
+// -- Filesystem storage --
+
+type fsStorage struct {
+	root string
+}
+
+type fsStorageFile struct {
+	*os.File
+}
+
+func newFsStorage(root string) *fsStorage {
+	return &fsStorage{root: root}
+}
+
+func (f fsStorageFile) Stat() (storageFileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return storageFileInfo{}, err
+	}
+	return storageFileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *fsStorage) ListProjects() ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	projects := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			projects = append(projects, e.Name())
+		}
+	}
+	return projects, nil
+}
+
+func (s *fsStorage) ListRuns(project string) ([]storageRunInfo, error) {
+	projectPath := filepath.Join(s.root, project)
+
+	entries, err := os.ReadDir(projectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]storageRunInfo, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		runId := e.Name()
+		if !e.IsDir() {
+			// Archived runs live next to the run directories, see archive.go
+			var isArchive bool
+			runId, _, isArchive = archiveRunId(e.Name())
+			if !isArchive || !e.Type().IsRegular() {
+				continue
+			}
+		}
+		if seen[runId] {
+			continue
+		}
+
+		info, err := os.Stat(filepath.Join(projectPath, e.Name()))
+		if err != nil {
+			continue
+		}
+
+		seen[runId] = true
+		runs = append(runs, storageRunInfo{Id: runId, ModTime: info.ModTime()})
+	}
+	return runs, nil
+}
+
+func (s *fsStorage) open(path string) (storageFile, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return fsStorageFile{fd}, nil
+}
+
+func (s *fsStorage) OpenProjectFile(project string, name string) (storageFile, error) {
+	return s.open(filepath.Join(s.root, project, name))
+}
+
+// Reports whether a missing run file should be looked up in an archive instead,
+// which is the case when the run has no directory
+func (s *fsStorage) isArchivedRun(project string, run string, err error) bool {
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(s.root, project, run))
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func (s *fsStorage) OpenRunFile(project string, run string, name string) (storageFile, error) {
+	fd, err := s.open(filepath.Join(s.root, project, run, name))
+	if s.isArchivedRun(project, run, err) {
+		return s.openArchivedRunFile(project, run, name)
+	}
+	return fd, err
+}
+
+func (s *fsStorage) StatRunFile(project string, run string, name string) (storageFileInfo, error) {
+	info, err := os.Stat(filepath.Join(s.root, project, run, name))
+	if s.isArchivedRun(project, run, err) {
+		fd, err := s.openArchivedRunFile(project, run, name)
+		if err != nil {
+			return storageFileInfo{}, err
+		}
+		defer fd.Close()
+		return fd.Stat()
+	}
+	if err != nil {
+		return storageFileInfo{}, err
+	}
+	return storageFileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -- S3 storage --
+//
+// Serves projects and runs out of an S3-compatible bucket, laid out exactly
+// like `projects_dir` (`<prefix><project>/<run>/<file>`). Projects and runs are
+// listed as common prefixes, reads are done with ranged GETs and stats with HEADs.
+// Prefixes have no timestamps, so a run's is the time its plan was written,
+// HEADed once per run and then kept in memory.
+// Requests are signed with AWS Signature Version 4, or sent anonymously if no
+// credentials are configured.
+
+type s3StorageConfig struct {
+	Endpoint  string `toml:"endpoint" json:"endpoint"`
+	Region    string `toml:"region" json:"region"`
+	Bucket    string `toml:"bucket" json:"bucket"`
+	Prefix    string `toml:"prefix" json:"prefix"`
+	AccessKey string `toml:"access_key" json:"-"`
+	SecretKey string `toml:"secret_key" json:"-"`
+	PathStyle bool   `toml:"path_style" json:"path_style"`
+	TimeoutMs int    `toml:"timeout_ms" json:"timeout_ms"`
+}
+
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+
+	mu sync.Mutex
+	// Project -> run -> modification time of its plan, see ListRuns
+	runTimes map[string]map[string]time.Time
+}
+
+func newS3Storage(cfg s3StorageConfig) (*s3Storage, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s'", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	// Fall back to the usual AWS environment variables, so secrets can stay out of the config file
+	accessKey := cfg.AccessKey
+	secretKey := cfg.SecretKey
+	if accessKey == "" && secretKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Storage{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    cfg.Bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: cfg.PathStyle,
+		runTimes:  make(map[string]map[string]time.Time),
+		// Only limit the time to the response headers, object bodies are streamed to clients
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ResponseHeaderTimeout: time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		}},
+	}, nil
+}
+
+// Encodes a string the way SigV4 expects it (RFC 3986 unreserved characters are kept)
+func s3UriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func s3HmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s *s3Storage) newRequest(method string, key string, query url.Values) (*http.Request, error) {
+	host := s.endpoint.Host
+	path := s.endpoint.Path
+	if s.pathStyle {
+		path = strings.TrimSuffix(path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		host = s.bucket + "." + host
+		path = strings.TrimSuffix(path, "/") + "/" + key
+	}
+
+	// Build the query by hand, since SigV4 needs it sorted and encoded in a specific way
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	queryParts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			queryParts = append(queryParts, s3UriEncode(k, true)+"="+s3UriEncode(v, true))
+		}
+	}
+	rawQuery := strings.Join(queryParts, "&")
+
+	reqUrl := &url.URL{
+		Scheme:   s.endpoint.Scheme,
+		Host:     host,
+		Path:     path,
+		RawPath:  s3UriEncode(path, false),
+		RawQuery: rawQuery,
+	}
+	req, err := http.NewRequest(method, reqUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = reqUrl
+	return req, nil
+}
+
+// Signs a request with AWS Signature Version 4. Only requests without a body are used.
+func (s *s3Storage) sign(req *http.Request, now time.Time) {
+	if s.accessKey == "" {
+		return
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := hex.EncodeToString(sha256.New().Sum(nil))
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := s3HmacSha256([]byte("AWS4"+s.secretKey), date)
+	signingKey = s3HmacSha256(signingKey, s.region)
+	signingKey = s3HmacSha256(signingKey, "s3")
+	signingKey = s3HmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func (s *s3Storage) do(method string, key string, query url.Values, rangeHeader string) (*http.Response, error) {
+	req, err := s.newRequest(method, key, query)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	s.sign(req, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s '%s': %w", method, key, fs.ErrNotExist)
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s '%s': %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// Lists the names of the "directories" directly under the given prefix
+func (s *s3Storage) listPrefixes(prefix string) ([]string, error) {
+	names := []string{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do("GET", "", query, "")
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	// Mimic the filesystem, where a missing directory is an error
+	if len(names) == 0 && prefix != s.prefix {
+		return nil, fmt.Errorf("s3 prefix '%s': %w", prefix, fs.ErrNotExist)
+	}
+	return names, nil
+}
+
+func (s *s3Storage) head(key string) (storageFileInfo, error) {
+	resp, err := s.do("HEAD", key, nil, "")
+	if err != nil {
+		return storageFileInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return storageFileInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Storage) ListProjects() ([]string, error) {
+	return s.listPrefixes(s.prefix)
+}
+
+func (s *s3Storage) ListRuns(project string) ([]storageRunInfo, error) {
+	runIds, err := s.listPrefixes(s.prefix + project + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	known := s.runTimes[project]
+	s.mu.Unlock()
+
+	// Only runs that weren't listed before are HEADed, runs that are gone are forgotten
+	runs := make([]storageRunInfo, 0, len(runIds))
+	times := make(map[string]time.Time, len(runIds))
+	for _, runId := range runIds {
+		modTime, ok := known[runId]
+		if !ok {
+			info, err := s.head(s.prefix + project + "/" + runId + "/plan.json")
+			if err != nil {
+				continue
+			}
+			modTime = info.ModTime
+		}
+		times[runId] = modTime
+		runs = append(runs, storageRunInfo{Id: runId, ModTime: modTime})
+	}
+
+	s.mu.Lock()
+	s.runTimes[project] = times
+	s.mu.Unlock()
+	return runs, nil
+}
+
+func (s *s3Storage) open(key string) (storageFile, error) {
+	info, err := s.head(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{storage: s, key: key, info: info}, nil
+}
+
+func (s *s3Storage) OpenProjectFile(project string, name string) (storageFile, error) {
+	return s.open(s.prefix + project + "/" + name)
+}
+
+func (s *s3Storage) OpenRunFile(project string, run string, name string) (storageFile, error) {
+	return s.open(s.prefix + project + "/" + run + "/" + name)
+}
+
+func (s *s3Storage) StatRunFile(project string, run string, name string) (storageFileInfo, error) {
+	return s.head(s.prefix + project + "/" + run + "/" + name)
+}
+
+// An object read with `Range: bytes=offset-` requests. The response body is
+// kept open across reads, and reading again after EOF issues a new request,
+// so objects that are rewritten with more data are followed like local files.
+type s3File struct {
+	storage *s3Storage
+	key     string
+	info    storageFileInfo
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.body == nil {
+		resp, err := f.storage.do("GET", f.key, nil, fmt.Sprintf("bytes=%d-", f.offset))
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			resp.Body.Close()
+			return 0, io.EOF
+		}
+		if resp.StatusCode == http.StatusOK && f.offset != 0 {
+			// The server ignored the range, skip to the offset ourselves
+			_, err = io.CopyN(io.Discard, resp.Body, f.offset)
+			if err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		}
+		if total := s3RangeTotal(resp.Header.Get("Content-Range")); total > f.info.Size {
+			f.info.Size = total
+		}
+		f.body = resp.Body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err != nil {
+		f.body.Close()
+		f.body = nil
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// Parses the total size out of a `Content-Range: bytes start-end/total` header
+func s3RangeTotal(contentRange string) int64 {
+	_, totalStr, found := strings.Cut(contentRange, "/")
+	if !found {
+		return -1
+	}
+	total, err := strconv.ParseInt(totalStr, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	newOffset, err := seekOffset(f.offset, f.info.Size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if newOffset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = newOffset
+	return newOffset, nil
+}
+
+func (f *s3File) Stat() (storageFileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		err := f.body.Close()
+		f.body = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"sync"
+	"time"
+)
+
+// -- Shared tailers --
+//
+// Every followed run file (status files and test logs) is read by a single
+// tailer goroutine, no matter how many clients are viewing it. The tailer keeps
+// a bounded ring of the most recent complete lines, already parsed, and wakes
+// up all of its subscribers whenever new lines arrive. It stops once the last
+// subscriber leaves.
+//
+// Subscribers that start before the oldest line in the ring (e.g. a log viewer
+// starting from the top of a long log) read that history from their own file
+// descriptor, and switch over to the ring once they catch up.
+//
+// Lines longer than `tailMaxLineBytes` (the limit of bufio.Scanner, which used
+// to read these files) are cut into pieces of that size, so a file without
+// newlines can't fill up the memory.
+
+const tailMaxLineBytes = 64 * 1024
+
+type tailLine struct {
+	Data        []byte
+	StartOffset int64
+	EndOffset   int64
+	// Whatever the parse function of the tailer returned for this line
+	Parsed interface{}
+	Valid  bool
+}
+
+type tailParseFunc func(line []byte) (interface{}, bool)
+
+// A file is tailed separately for each kind of parse function, so subscribers
+// always get the lines parsed the way they expect
+type tailKey struct {
+	watchKey
+	kind string
+}
+
+type fileTailer struct {
+	key   tailKey
+	parse tailParseFunc
+	refs  int
+	stop  chan struct{}
+
+	mu      sync.Mutex
+	ring    []tailLine
+	ringLen int
+	offset  int64
+	changed chan struct{}
+	err     error
+}
+
+type tailerHub struct {
+	mu      sync.Mutex
+	tailers map[tailKey]*fileTailer
+}
+
+var tailers = &tailerHub{tailers: make(map[tailKey]*fileTailer)}
+
+var errTailerDone = errors.New("tailer subscription done")
+
+// Returns the shared tailer of a run file, starting it if needed. `kind` names
+// the parse function, which like the poll interval is only used by the first
+// subscriber of a file, and release must be called once done.
+func (h *tailerHub) tail(project string, run string, name string, kind string, parse tailParseFunc, pollInterval time.Duration) (*fileTailer, func()) {
+	key := tailKey{watchKey{project, run, name}, kind}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	tailer, ok := h.tailers[key]
+	if !ok {
+		tailer = &fileTailer{
+			key:     key,
+			parse:   parse,
+			stop:    make(chan struct{}),
+			changed: make(chan struct{}),
+		}
+		h.tailers[key] = tailer
+		go tailer.run(pollInterval)
+	}
+	tailer.refs++
+
+	return tailer, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		tailer.refs--
+		if tailer.refs > 0 {
+			return
+		}
+		close(tailer.stop)
+		delete(h.tailers, key)
+	}
+}
+
+// Splits the complete lines out of a buffer, returning them, the leftover
+// partial line, and the offset it starts at. Empty lines are skipped, but
+// still count towards the offset, and long lines are cut, see above.
+func splitTailLines(buf []byte, offset int64, parse tailParseFunc) ([]tailLine, []byte, int64) {
+	lines := []tailLine{}
+	for {
+		line_end := bytes.IndexByte(buf, '\n')
+		consumed := line_end + 1
+		if line_end < 0 || line_end > tailMaxLineBytes {
+			if len(buf) < tailMaxLineBytes {
+				return lines, buf, offset
+			}
+			line_end, consumed = tailMaxLineBytes, tailMaxLineBytes
+		}
+		data := buf[:line_end]
+		buf = buf[consumed:]
+		if len(data) > 0 {
+			parsed, valid := parse(data)
+			lines = append(lines, tailLine{
+				Data:        bytes.Clone(data),
+				StartOffset: offset,
+				EndOffset:   offset + int64(consumed),
+				Parsed:      parsed,
+				Valid:       valid,
+			})
+		}
+		offset += int64(consumed)
+	}
+}
+
+func (t *fileTailer) run(pollInterval time.Duration) {
+	watch, release := watcher.watch(t.key.project, t.key.run, t.key.name, pollInterval)
+	defer release()
+
+	var fd storageFile
+	defer func() {
+		if fd != nil {
+			fd.Close()
+		}
+	}()
+
+	chunk := make([]byte, config.StatusStream.ChunkSize)
+	pending := []byte{}
+	offset := int64(0)
+	for {
+		changed := watch.Changed()
+
+		if fd == nil {
+			var err error
+			fd, err = openRunFileMaybeCompressed(t.key.project, t.key.run, t.key.name)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				t.fail(err)
+				return
+			}
+		}
+
+		for fd != nil {
+			n, err := fd.Read(chunk)
+			if n > 0 {
+				pending = append(pending, chunk[:n]...)
+				var lines []tailLine
+				lines, pending, offset = splitTailLines(pending, offset, t.parse)
+				t.append(lines, offset)
+			}
+			if err == io.EOF || n == 0 {
+				break
+			}
+			if err != nil {
+				t.fail(err)
+				return
+			}
+		}
+
+		select {
+		case <-t.stop:
+			return
+		case <-changed:
+		}
+	}
+}
+
+// Adds new lines to the ring, `offset` is where the file was read up to
+func (t *fileTailer) append(lines []tailLine, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.offset = offset
+	if len(lines) == 0 {
+		return
+	}
+	for _, line := range lines {
+		t.ring = append(t.ring, line)
+		t.ringLen += len(line.Data)
+	}
+
+	// Drop the oldest lines, but always keep the newest one
+	drop := 0
+	for len(t.ring)-drop > 1 && (len(t.ring)-drop > config.Tailer.RingLines || t.ringLen > config.Tailer.RingBytes) {
+		t.ringLen -= len(t.ring[drop].Data)
+		drop++
+	}
+	if drop > 0 {
+		t.ring = append([]tailLine(nil), t.ring[drop:]...)
+	}
+
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *fileTailer) fail(err error) {
+	log.Printf("Tailer of '%s/%s/%s' stopped: %v", t.key.project, t.key.run, t.key.name, err)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// Returns the lines in the ring starting at or after the offset, and the
+// offset the file was read up to. The result is not ok if the offset is older
+// than the ring, so it must be read from the file.
+func (t *fileTailer) linesSince(offset int64) ([]tailLine, int64, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.ring) == 0 {
+		return nil, t.offset, offset >= t.offset, t.err
+	}
+	if offset < t.ring[0].StartOffset {
+		return nil, t.offset, false, t.err
+	}
+	for i, line := range t.ring {
+		if line.StartOffset >= offset {
+			return t.ring[i:len(t.ring):len(t.ring)], t.offset, true, t.err
+		}
+	}
+	return nil, t.offset, true, t.err
+}
+
+// Returns a channel that is closed when new lines are available
+func (t *fileTailer) Changed() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.changed
+}
+
+// A single reader of a shared tailer, see above
+type tailSubscription struct {
+	tailer  *fileTailer
+	offset  int64
+	fd      storageFile
+	pending []byte
+	chunk   []byte
+}
+
+func (t *fileTailer) subscribe(offset int64) *tailSubscription {
+	return &tailSubscription{tailer: t, offset: offset}
+}
+
+func (s *tailSubscription) Offset() int64 {
+	return s.offset
+}
+
+func (s *tailSubscription) Changed() <-chan struct{} {
+	return s.tailer.Changed()
+}
+
+// Returns the lines that are available right now. If more is set, there are
+// already more lines to read, so Poll should be called again without waiting.
+func (s *tailSubscription) Poll() (lines []tailLine, more bool, err error) {
+	lines, end_offset, ok, err := s.tailer.linesSince(s.offset)
+	if ok {
+		s.closeFile()
+		s.offset = max(s.offset, end_offset)
+		return lines, false, err
+	}
+
+	// We are behind the ring, read one chunk of the history ourselves
+	if s.fd == nil {
+		s.fd, err = openRunFileMaybeCompressed(s.tailer.key.project, s.tailer.key.run, s.tailer.key.name)
+		if err != nil {
+			return nil, false, err
+		}
+		_, err = s.fd.Seek(s.offset, io.SeekStart)
+		if err != nil {
+			return nil, false, err
+		}
+		s.chunk = make([]byte, config.StatusStream.ChunkSize)
+		s.pending = nil
+	}
+	n, err := s.fd.Read(s.chunk)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	s.pending = append(s.pending, s.chunk[:n]...)
+	lines, s.pending, s.offset = splitTailLines(s.pending, s.offset, s.tailer.parse)
+	return lines, n > 0, nil
+}
+
+// Waits for and returns the next lines, or errTailerDone once any of the cancel channels fires
+func (s *tailSubscription) Next(cancel ...interface{}) ([]tailLine, error) {
+	for {
+		changed := s.Changed()
+		lines, more, err := s.Poll()
+		if len(lines) > 0 || err != nil {
+			return lines, err
+		}
+		if more {
+			continue
+		}
+		if !waitForChanges([]<-chan struct{}{changed}, cancel...) {
+			return nil, errTailerDone
+		}
+	}
+}
+
+func (s *tailSubscription) closeFile() {
+	if s.fd != nil {
+		s.fd.Close()
+		s.fd = nil
+	}
+}
+
+func (s *tailSubscription) Close() {
+	s.closeFile()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func parseTestTailLine(line []byte) (interface{}, bool) {
+	return string(line), true
+}
+
+func TestSplitTailLines(t *testing.T) {
+	cases := []struct {
+		buf     string
+		offsets [][2]int64
+		rest    string
+		end     int64
+	}{
+		{buf: "a\nbc\n", offsets: [][2]int64{{10, 12}, {12, 15}}, end: 15},
+		{buf: "a\n\n\nbc\npartial", offsets: [][2]int64{{10, 12}, {14, 17}}, rest: "partial", end: 17},
+		// Blank lines are never returned, but still move the offset
+		{buf: "a\n\n\n", offsets: [][2]int64{{10, 12}}, end: 14},
+		{buf: "\n\n", end: 12},
+		{buf: "partial", rest: "partial", end: 10},
+		// Long lines are cut, with or without their newline
+		{buf: strings.Repeat("x", tailMaxLineBytes+1), offsets: [][2]int64{{10, 10 + tailMaxLineBytes}}, rest: "x", end: 10 + tailMaxLineBytes},
+		{buf: strings.Repeat("x", tailMaxLineBytes+1) + "\n", offsets: [][2]int64{{10, 10 + tailMaxLineBytes}, {10 + tailMaxLineBytes, 12 + tailMaxLineBytes}}, end: 12 + tailMaxLineBytes},
+		{buf: strings.Repeat("x", 2*tailMaxLineBytes), offsets: [][2]int64{{10, 10 + tailMaxLineBytes}, {10 + tailMaxLineBytes, 10 + 2*tailMaxLineBytes}}, end: 10 + 2*tailMaxLineBytes},
+	}
+	for _, c := range cases {
+		lines, rest, end := splitTailLines([]byte(c.buf), 10, parseTestTailLine)
+		if len(lines) != len(c.offsets) {
+			t.Errorf("%q: %d lines, expected %d", c.buf, len(lines), len(c.offsets))
+			continue
+		}
+		for i, line := range lines {
+			if line.StartOffset != c.offsets[i][0] || line.EndOffset != c.offsets[i][1] {
+				t.Errorf("%q: line %d at %d-%d, expected %d-%d", c.buf, i, line.StartOffset, line.EndOffset, c.offsets[i][0], c.offsets[i][1])
+			}
+		}
+		if string(rest) != c.rest || end != c.end {
+			t.Errorf("%q: rest %q at %d, expected %q at %d", c.buf, rest, end, c.rest, c.end)
+		}
+	}
+}
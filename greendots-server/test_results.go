@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -- Test results --
+//
+// The final result of every planned test of a run. This is the index behind
+// the cross-run endpoints (test history, ...): once a run is finished its
+// results are saved under `state_dir` next to its summary, so they are never
+// computed from the status files again. Without `state_dir`, only the results
+// of the last `testResultsCacheMaxRuns` runs used are kept, in memory.
+
+// Bumped whenever the saved results should be computed again
+const testResultsVersion = 1
+
+const testResultsCacheMaxRuns = 256
+
+const (
+	testOutcomeRunning    = "running"
+	testOutcomeNotStarted = "not_started"
+)
+
+type testResult struct {
+	// passed, failed, skipped, error, running or not_started
+	Outcome string `json:"outcome"`
+	// Seconds from the start of the test to its finish, zero if unknown
+	Duration float64 `json:"duration,omitempty"`
+	// Seconds spent in each phase of the test, see testPhaseTimes
+	Setup          float64 `json:"setup,omitempty"`
+	Call           float64 `json:"call,omitempty"`
+	Teardown       float64 `json:"teardown,omitempty"`
+	ExceptionTitle string  `json:"exception_title,omitempty"`
+	// The test failed, and then passed when it was run again
+	PassedOnRerun bool `json:"passed_on_rerun,omitempty"`
+	// "crashed" or "hung" for an "error" of a test that will never finish, see lost_tests.go
+	Lost string `json:"lost,omitempty"`
+}
+
+type savedTestResults struct {
+	Version int                   `json:"version"`
+	Tests   map[string]testResult `json:"tests"`
+}
+
+type testResultsEntry struct {
+	tests    map[string]testResult
+	lastUsed time.Time
+}
+
+var testResultsCache = struct {
+	sync.Mutex
+	entries map[runPlanCacheKey]*testResultsEntry
+}{entries: make(map[runPlanCacheKey]*testResultsEntry)}
+
+func testResultsPath(project string, run string) string {
+	return filepath.Join(config.StateDir, "results", project, run+".json")
+}
+
+// The frontend shows the last line of an exception as its title
+func exceptionTitle(exception string) string {
+	exception = strings.TrimSpace(exception)
+	return strings.TrimSpace(exception[strings.LastIndexByte(exception, '\n')+1:])
+}
+
+// Returns the worker whose status of a test is its result, and that status,
+// or -1 if the test didn't start
+func findTestStatus(snapshots []statusSnapshot, test string) (int, map[string]interface{}) {
+	for worker_id, snapshot := range snapshots {
+		if status_obj, ok := snapshot.Statuses[test]; ok {
+			return worker_id, status_obj
+		}
+	}
+	return -1, nil
+}
+
+func computeTestResults(plan *runPlan, snapshots []statusSnapshot) map[string]testResult {
+	lost := make([]map[string]string, len(snapshots))
+	for worker_id, snapshot := range snapshots {
+		lost[worker_id] = findLostTests(snapshot)
+	}
+
+	results := make(map[string]testResult)
+	for _, group := range plan.Groups {
+		for _, test_item := range group {
+			var started float64
+			var phases testPhaseTimes
+			result := testResult{}
+			worker_id, status_obj := findTestStatus(snapshots, test_item.Id)
+			if worker_id >= 0 {
+				started = snapshots[worker_id].Started[test_item.Id]
+				phases = snapshots[worker_id].Phases[test_item.Id]
+				result.PassedOnRerun = snapshots[worker_id].PassedOnRerun[test_item.Id]
+			}
+
+			switch {
+			case status_obj == nil:
+				result.Outcome = testOutcomeNotStarted
+			case lost[worker_id][test_item.Id] != "":
+				// Without reading its log, unlike the status summary
+				result.Outcome = "error"
+				result.Lost = lost[worker_id][test_item.Id]
+				result.ExceptionTitle = lostTestMessage(worker_id, result.Lost)
+				results[test_item.Id] = result
+				continue
+			case status_obj["type"] != "finish":
+				result.Outcome = testOutcomeRunning
+			default:
+				switch status_obj["outcome"] {
+				case "passed", "failed", "skipped":
+					result.Outcome = status_obj["outcome"].(string)
+				default:
+					result.Outcome = "error"
+				}
+				if finished, ok := status_obj["time"].(float64); ok && started != 0 {
+					result.Duration = finished - started
+				}
+				result.Setup = phases.Setup
+				result.Call = phases.Call
+				result.Teardown = phases.Teardown
+			}
+			if exception, ok := status_obj["exception"].(string); ok && result.Outcome != "passed" {
+				result.ExceptionTitle = exceptionTitle(exception)
+			}
+			results[test_item.Id] = result
+		}
+	}
+	return results
+}
+
+// Returns the results of all the planned tests of a run, which must not be
+// modified. `created` is the modification time of the run, see getRunSummary.
+func getRunTestResults(project string, run string, created time.Time) (map[string]testResult, error) {
+	key := runPlanCacheKey{project, run}
+	if tests, ok := loadTestResults(key); ok {
+		return tests, nil
+	}
+
+	// Check whether the run is finished before reading the statuses, so
+	// nothing written in between is missed
+	summary := getRunSummary(project, run, created)
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		return nil, err
+	}
+	tests := computeTestResults(plan, getStatusSnapshots(project, run, plan))
+	if summary.State == runStateFinished {
+		storeTestResults(key, tests)
+		statusSummaryCache.forgetRun(project, run)
+	}
+	return tests, nil
+}
+
+func loadTestResults(key runPlanCacheKey) (map[string]testResult, bool) {
+	testResultsCache.Lock()
+	if entry, ok := testResultsCache.entries[key]; ok {
+		entry.lastUsed = time.Now()
+		testResultsCache.Unlock()
+		return entry.tests, true
+	}
+	testResultsCache.Unlock()
+
+	if config.StateDir == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(testResultsPath(key.project, key.run))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to read the test results of '%s/%s': %v", key.project, key.run, err)
+		}
+		return nil, false
+	}
+	var saved savedTestResults
+	err = json.Unmarshal(data, &saved)
+	if err != nil || saved.Version != testResultsVersion {
+		return nil, false
+	}
+	cacheTestResults(key, saved.Tests)
+	return saved.Tests, true
+}
+
+func storeTestResults(key runPlanCacheKey, tests map[string]testResult) {
+	cacheTestResults(key, tests)
+	if config.StateDir == "" {
+		return
+	}
+
+	data, err := json.Marshal(savedTestResults{Version: testResultsVersion, Tests: tests})
+	if err == nil {
+		err = writeStateFile(testResultsPath(key.project, key.run), data)
+	}
+	if err != nil {
+		log.Printf("Failed to save the test results of '%s/%s': %v", key.project, key.run, err)
+	}
+}
+
+func cacheTestResults(key runPlanCacheKey, tests map[string]testResult) {
+	testResultsCache.Lock()
+	defer testResultsCache.Unlock()
+
+	if _, ok := testResultsCache.entries[key]; !ok && len(testResultsCache.entries) >= testResultsCacheMaxRuns {
+		// Evict the least recently used run
+		var oldestKey runPlanCacheKey
+		var oldest *testResultsEntry
+		for k, v := range testResultsCache.entries {
+			if oldest == nil || v.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = k, v
+			}
+		}
+		delete(testResultsCache.entries, oldestKey)
+	}
+	testResultsCache.entries[key] = &testResultsEntry{tests: tests, lastUsed: time.Now()}
+}
+
+// Forgets the results of a run that changed after it was finished
+func forgetTestResults(key runPlanCacheKey) {
+	testResultsCache.Lock()
+	delete(testResultsCache.entries, key)
+	testResultsCache.Unlock()
+
+	if config.StateDir == "" {
+		return
+	}
+	err := os.Remove(testResultsPath(key.project, key.run))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove the test results of '%s/%s': %v", key.project, key.run, err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// -- Worker timeline --
+//
+// The tests each worker ran, in order, along with the gaps in which it wasn't
+// running anything: between two tests, before its first test (from the start
+// of the run) and after its last one (until the last activity of the run).
+// Gaps shorter than `min_gap_ms` are left out.
+
+type timelineGap struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type workerTimeline struct {
+	Worker int `json:"worker"`
+	// The last "time" in the status file of the worker, zero if it has none
+	LastSeen float64        `json:"last_seen"`
+	Tests    []timelineTest `json:"tests"`
+	Gaps     []timelineGap  `json:"gaps"`
+}
+
+type runTimeline struct {
+	// Range of the "time" fields over all the workers, zero if there are none
+	Start   float64          `json:"start"`
+	End     float64          `json:"end"`
+	Workers []workerTimeline `json:"workers"`
+}
+
+func computeRunTimeline(snapshots []statusSnapshot) runTimeline {
+	timeline := runTimeline{Workers: make([]workerTimeline, 0, len(snapshots))}
+	for _, snapshot := range snapshots {
+		if snapshot.FirstTime != 0 && (timeline.Start == 0 || snapshot.FirstTime < timeline.Start) {
+			timeline.Start = snapshot.FirstTime
+		}
+		timeline.End = max(timeline.End, snapshot.LastTime)
+	}
+
+	min_gap := float64(config.Timeline.MinGapMs) / 1000
+	for idx, snapshot := range snapshots {
+		worker := workerTimeline{
+			Worker:   idx,
+			LastSeen: snapshot.LastTime,
+			Tests:    snapshot.Timeline,
+			Gaps:     []timelineGap{},
+		}
+		if worker.Tests == nil {
+			worker.Tests = []timelineTest{}
+		}
+
+		idle_since := timeline.Start
+		for _, test := range worker.Tests {
+			if idle_since != 0 && test.Start-idle_since >= min_gap {
+				worker.Gaps = append(worker.Gaps, timelineGap{Start: idle_since, End: test.Start})
+			}
+			// Zero while the test is running, nothing is idle then
+			idle_since = test.End
+		}
+		if idle_since != 0 && timeline.End-idle_since >= min_gap {
+			worker.Gaps = append(worker.Gaps, timelineGap{Start: idle_since, End: timeline.End})
+		}
+		timeline.Workers = append(timeline.Workers, worker)
+	}
+	return timeline
+}
+
+func runTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	project := r.PathValue("project")
+	run := r.PathValue("run")
+	if isDirTraversal(project) || isDirTraversal(run) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	plan, err := getRunPlan(project, run)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(computeRunTimeline(getStatusSnapshots(project, run, plan)))
+	if err != nil {
+		log.Printf("%s %s: json encoder: %v", r.Method, r.URL.Path, err)
+		return
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// -- File watching --
+//
+// Handlers waiting for a run file to change subscribe to a shared watch of
+// that file, instead of each one polling it on its own. Every watch has a
+// single poller that stats the file, and when `projects_dir` is on a local
+// filesystem, inotify wakes up the waiters right away (the poller then only
+// runs every `safety_poll_ms`, in case an event is lost). Network filesystems
+// don't report changes made by other hosts, so they are only polled.
+//
+// Waiters must take the channel from Changed() *before* checking the file,
+// so a change that happens in between is never missed.
+
+type watchKey struct {
+	project string
+	run     string
+	name    string
+}
+
+type fileWatch struct {
+	key watchKey
+	hub *watcherHub
+	// Whether the run directory is watched with inotify on behalf of this watch
+	inDir   bool
+	refs    int
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+type watchDir struct {
+	project string
+	run     string
+	refs    int
+}
+
+type watcherHub struct {
+	mu      sync.Mutex
+	watches map[watchKey]*fileWatch
+	// Run directories watched with inotify, by path
+	dirs       map[string]*watchDir
+	notify     *fsnotify.Watcher
+	root       string
+	safetyPoll time.Duration
+}
+
+var watcher *watcherHub
+
+func newWatcherHub() *watcherHub {
+	hub := &watcherHub{
+		watches:    make(map[watchKey]*fileWatch),
+		dirs:       make(map[string]*watchDir),
+		safetyPoll: time.Duration(config.Watcher.SafetyPollMs) * time.Millisecond,
+	}
+
+	// inotify only makes sense for runs in a local `projects_dir`
+	fsStore, ok := storage.(*fsStorage)
+	if !ok {
+		return hub
+	}
+	mode := config.Watcher.Mode
+	if mode == "auto" {
+		mode = "inotify"
+		if isNetworkFilesystem(fsStore.root) {
+			mode = "poll"
+		}
+	}
+	if mode != "inotify" {
+		log.Printf("Watching run files by polling")
+		return hub
+	}
+
+	notify, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to start inotify, watching run files by polling: %v", err)
+		return hub
+	}
+	log.Printf("Watching run files with inotify")
+	hub.notify = notify
+	hub.root = fsStore.root
+	go hub.notifyLoop()
+	return hub
+}
+
+func (h *watcherHub) notifyLoop() {
+	for {
+		select {
+		case event, ok := <-h.notify.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			h.mu.Lock()
+			dir, ok := h.dirs[filepath.Dir(event.Name)]
+			if ok {
+				h.broadcastLocked(watchKey{dir.project, dir.run, filepath.Base(event.Name)})
+			}
+			h.mu.Unlock()
+		case err, ok := <-h.notify.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("inotify: %v", err)
+		}
+	}
+}
+
+func (h *watcherHub) broadcastLocked(key watchKey) {
+	watch, ok := h.watches[key]
+	if !ok {
+		return
+	}
+	close(watch.changed)
+	watch.changed = make(chan struct{})
+}
+
+// Subscribes to changes of a run file. The poll interval is only used by the
+// first subscriber of a file, and release must be called once done.
+func (h *watcherHub) watch(project string, run string, name string, pollInterval time.Duration) (*fileWatch, func()) {
+	key := watchKey{project, run, name}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	watch, ok := h.watches[key]
+	if !ok {
+		watch = &fileWatch{
+			key:     key,
+			hub:     h,
+			changed: make(chan struct{}),
+			stop:    make(chan struct{}),
+		}
+		h.watches[key] = watch
+
+		if h.notify != nil {
+			watch.inDir = h.addDirLocked(project, run)
+			if watch.inDir {
+				pollInterval = h.safetyPoll
+			}
+		}
+		go h.poll(watch, pollInterval)
+	}
+	watch.refs++
+
+	return watch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		watch.refs--
+		if watch.refs > 0 {
+			return
+		}
+		close(watch.stop)
+		delete(h.watches, key)
+		if watch.inDir {
+			h.removeDirLocked(project, run)
+		}
+	}
+}
+
+// Returns false if the directory can't be watched
+func (h *watcherHub) addDirLocked(project string, run string) bool {
+	path := filepath.Join(h.root, project, run)
+	if dir, ok := h.dirs[path]; ok {
+		dir.refs++
+		return true
+	}
+	// Archived runs have no directory, the poller still covers them
+	err := h.notify.Add(path)
+	if err != nil {
+		return false
+	}
+	h.dirs[path] = &watchDir{project: project, run: run, refs: 1}
+	return true
+}
+
+func (h *watcherHub) removeDirLocked(project string, run string) {
+	path := filepath.Join(h.root, project, run)
+	dir, ok := h.dirs[path]
+	if !ok {
+		return
+	}
+	dir.refs--
+	if dir.refs > 0 {
+		return
+	}
+	delete(h.dirs, path)
+	h.notify.Remove(path)
+}
+
+func (h *watcherHub) poll(watch *fileWatch, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, lastErr := storage.StatRunFile(watch.key.project, watch.key.run, watch.key.name)
+	for {
+		select {
+		case <-watch.stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := storage.StatRunFile(watch.key.project, watch.key.run, watch.key.name)
+		if info != last || (err == nil) != (lastErr == nil) {
+			h.mu.Lock()
+			h.broadcastLocked(watch.key)
+			h.mu.Unlock()
+		}
+		last, lastErr = info, err
+	}
+}
+
+// Returns a channel that is closed on the next change of the file
+func (w *fileWatch) Changed() <-chan struct{} {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	return w.changed
+}
+
+// Waits until any of the changed channels is closed, returning false if
+// any of the cancel channels (of any element type) fired first
+func waitForChanges(changed []<-chan struct{}, cancel ...interface{}) bool {
+	cases := make([]reflect.SelectCase, 0, len(changed)+len(cancel))
+	for _, ch := range changed {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+	for _, ch := range cancel {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+	}
+	chosen, _, _ := reflect.Select(cases)
+	return chosen < len(changed)
+}
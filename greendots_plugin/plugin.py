@@ -327,6 +327,7 @@ class LivelogPlugin:
             "type": report.when,
             "outcome": report.outcome,
             "test": report.nodeid,
+            "duration": report.duration,
         }
 
         if report.outcome == "failed":
@@ -416,6 +417,24 @@ class LivelogPlugin:
         with open(os.path.join(self._log_path, "plan.json"), "w") as f:
             json.dump(plan, f, sort_keys=True, default=json_encode_default, indent=4)
 
+    def should_create_end_marker(self, session: pytest.Session) -> bool:
+        # with an explicit worker id every process only runs part of the tests,
+        # so only the server can tell when all of them are done
+        if self._log_path is None or isinstance(self._worker_id, int):
+            return False
+        elif self._xdist_supported:
+            import xdist
+
+            return not xdist.is_xdist_worker(session)
+        return True
+
+    def pytest_sessionfinish(self, session: pytest.Session, exitstatus):
+        if not self.should_create_end_marker(session):
+            return
+
+        with open(os.path.join(self._log_path, "end.json"), "w") as f:
+            json.dump({"time": time.time(), "exitstatus": int(exitstatus)}, f)
+
     def pytest_runtest_logstart(self, nodeid, location):
         # we are not a worker, ignore
         if self._status_file is None: